@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// BookmarkFolder groups bookmarks and other folders. Folders and bookmarks in
+// the same parent share one ordering, given by their positions, so that a
+// browser's bookmark bar can be synced as is.
+type BookmarkFolder struct {
+	ID       *int64  `json:"id,omitempty"db:"id"`
+	Title    *string `json:"title,omitempty"db:"title"`
+	ParentID *int64  `json:"parent_id,omitempty"db:"parent_id"`
+	Position *int    `json:"position,omitempty"db:"position"`
+	OwnerID  *int64  `json:"owner_id,omitempty"db:"owner_id"`
+}
+
+var (
+	// errFolderNotFound is returned when a folder doesn't exist or belongs to
+	// someone else
+	errFolderNotFound = errors.New("folder not found")
+	// errFolderCycle is returned when a folder would be moved into itself or
+	// one of its descendants
+	errFolderCycle = errors.New("a folder can't be moved into itself or one of its subfolders")
+)
+
+// BookmarkFolderNode is a folder along with everything in it
+type BookmarkFolderNode struct {
+	*BookmarkFolder
+	Folders   []*BookmarkFolderNode `json:"folders"`
+	Bookmarks []*Bookmark           `json:"bookmarks"`
+}
+
+// BookmarkTree is all of a user's folders and bookmarks. The bookmarks and
+// folders at the top level aren't in any folder.
+type BookmarkTree struct {
+	Folders   []*BookmarkFolderNode `json:"folders"`
+	Bookmarks []*Bookmark           `json:"bookmarks"`
+}
+
+func positionOf(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// buildBookmarkTree arranges folders and bookmarks into a tree, each level
+// sorted by position. Anything whose folder is missing ends up at the top.
+func buildBookmarkTree(folders []*BookmarkFolder, bookmarks []*Bookmark) *BookmarkTree {
+	tree := &BookmarkTree{Folders: []*BookmarkFolderNode{}, Bookmarks: []*Bookmark{}}
+	nodes := make(map[int64]*BookmarkFolderNode, len(folders))
+	for _, f := range folders {
+		nodes[*f.ID] = &BookmarkFolderNode{BookmarkFolder: f, Folders: []*BookmarkFolderNode{}, Bookmarks: []*Bookmark{}}
+	}
+	for _, f := range folders {
+		node := nodes[*f.ID]
+		if parent := nodes[valueOrZero(f.ParentID)]; f.ParentID != nil && parent != nil {
+			parent.Folders = append(parent.Folders, node)
+		} else {
+			tree.Folders = append(tree.Folders, node)
+		}
+	}
+	for _, b := range bookmarks {
+		if folder := nodes[valueOrZero(b.FolderID)]; b.FolderID != nil && folder != nil {
+			folder.Bookmarks = append(folder.Bookmarks, b)
+		} else {
+			tree.Bookmarks = append(tree.Bookmarks, b)
+		}
+	}
+
+	sortFolders := func(folders []*BookmarkFolderNode) {
+		sort.SliceStable(folders, func(i, j int) bool {
+			return positionOf(folders[i].Position) < positionOf(folders[j].Position)
+		})
+	}
+	sortBookmarks := func(bookmarks []*Bookmark) {
+		sort.SliceStable(bookmarks, func(i, j int) bool {
+			return positionOf(bookmarks[i].Position) < positionOf(bookmarks[j].Position)
+		})
+	}
+	sortFolders(tree.Folders)
+	sortBookmarks(tree.Bookmarks)
+	for _, node := range nodes {
+		sortFolders(node.Folders)
+		sortBookmarks(node.Bookmarks)
+	}
+
+	return tree
+}
+
+func valueOrZero(id *int64) int64 {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+// loadBookmarkTree retrieves all of a user's folders and bookmarks as a tree
+func loadBookmarkTree(ownerID int64) (*BookmarkTree, map[int64]*BookmarkFolderNode, error) {
+	folders, err := db().BookmarkFolders(ownerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	bookmarks, err := db().Bookmarks(NewBookmarkQuery(ownerID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree := buildBookmarkTree(folders, bookmarks)
+	nodes := make(map[int64]*BookmarkFolderNode)
+	var index func([]*BookmarkFolderNode)
+	index = func(folders []*BookmarkFolderNode) {
+		for _, node := range folders {
+			nodes[*node.ID] = node
+			index(node.Folders)
+		}
+	}
+	index(tree.Folders)
+
+	return tree, nodes, nil
+}
+
+func parseFolderID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["folder_id"], 10, 64)
+	if err != nil {
+		sendBadReq(w, "invalid folder id")
+		return 0, false
+	}
+
+	return id, true
+}
+
+// sendFolderErr sends the response for the errors that creating or moving
+// something into a folder can return
+func sendFolderErr(w http.ResponseWriter, err error) {
+	switch err {
+	case errFolderNotFound:
+		sendNotFound(w, "folder not found")
+	case errFolderCycle:
+		sendBadReq(w, err.Error())
+	default:
+		sendInternalErr(w, err)
+	}
+}
+
+// CreateBookmarkFolderHandler handles POST /folders
+func CreateBookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	folder := &BookmarkFolder{}
+	if err := json.NewDecoder(r.Body).Decode(folder); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	folder.ID = nil
+	folder.OwnerID = &userID
+	if folder.Title == nil || strings.TrimSpace(*folder.Title) == "" {
+		sendBadReq(w, "You need to provide a 'title'")
+		return
+	}
+
+	id, err := db().CreateBookmarkFolder(folder)
+	if err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+
+	folder, err = db().BookmarkFolder(id, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, folder)
+}
+
+// GetBookmarkFolderTreeHandler handles GET /folders/tree
+func GetBookmarkFolderTreeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	tree, _, err := loadBookmarkTree(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, tree)
+}
+
+// GetBookmarkFolderHandler handles GET /folders/{folder_id}
+//
+// The folder is returned along with everything in it.
+func GetBookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	folderID, ok := parseFolderID(w, r)
+	if !ok {
+		return
+	}
+
+	_, nodes, err := loadBookmarkTree(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	node := nodes[folderID]
+	if node == nil {
+		sendNotFound(w, fmt.Sprintf("folder %d not found", folderID))
+		return
+	}
+
+	sendSuccess(w, node)
+}
+
+// EditBookmarkFolderHandler handles PUT /folders/{folder_id}
+//
+// Only the title can be changed here. Use POST /folders/{folder_id}/move to
+// move the folder.
+func EditBookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	folderID, ok := parseFolderID(w, r)
+	if !ok {
+		return
+	}
+
+	folder, err := db().BookmarkFolder(folderID, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if folder == nil {
+		sendNotFound(w, fmt.Sprintf("folder %d not found", folderID))
+		return
+	}
+
+	edits := &BookmarkFolder{}
+	if err = json.NewDecoder(r.Body).Decode(edits); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	if edits.Title != nil {
+		if strings.TrimSpace(*edits.Title) == "" {
+			sendBadReq(w, "the 'title' can't be empty")
+			return
+		}
+		folder.Title = edits.Title
+	}
+
+	if err = db().EditBookmarkFolder(folder); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, folder)
+}
+
+// DeleteBookmarkFolderHandler handles DELETE /folders/{folder_id}
+//
+// Everything in the folder, including subfolders, is deleted along with it.
+func DeleteBookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	folderID, ok := parseFolderID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db().DeleteBookmarkFolder(folderID, userID); err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
+
+// moveRequest is the body of the move endpoints. A missing or null parent
+// means the top level, and a missing position means the end.
+type moveRequest struct {
+	ParentID *int64 `json:"parent_id"`
+	FolderID *int64 `json:"folder_id"`
+	Position *int   `json:"position"`
+}
+
+func (mr *moveRequest) position() int {
+	if mr.Position == nil || *mr.Position < 0 {
+		return -1
+	}
+	return *mr.Position
+}
+
+// MoveBookmarkFolderHandler handles POST /folders/{folder_id}/move
+//
+// It moves the folder to 'position' in the folder 'parent_id'.
+func MoveBookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	folderID, ok := parseFolderID(w, r)
+	if !ok {
+		return
+	}
+
+	move := &moveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(move); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+
+	if err := db().MoveBookmarkFolder(folderID, userID, move.ParentID, move.position()); err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+
+	folder, err := db().BookmarkFolder(folderID, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, folder)
+}
+
+// MoveBookmarkHandler handles POST /bookmarks/{bookmark_id}/move
+//
+// It moves the bookmark to 'position' in the folder 'folder_id'.
+func MoveBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	bookmarkID, ok := parseBookmarkID(w, r)
+	if !ok {
+		return
+	}
+
+	move := &moveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(move); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+
+	err := db().MoveBookmark(bookmarkID, userID, move.FolderID, move.position())
+	if err == errBookmarkNotFound {
+		sendNotFound(w, fmt.Sprintf("bookmark %d not found", bookmarkID))
+		return
+	}
+	if err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+
+	bookmark, err := db().Bookmark(bookmarkID, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, bookmark)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// The snippets returned with search results are built with these markers
+// around each match. They're replaced with <mark> tags once the rest of the
+// snippet has been escaped, so that a bookmark's title can't inject HTML.
+const (
+	snippetMatchStart = "\x02"
+	snippetMatchEnd   = "\x03"
+	snippetEllipsis   = "…"
+	// snippetWords is roughly how many words of context a snippet has
+	snippetWords = 12
+)
+
+// searchTerms splits a search into the words that bookmarks need to contain
+func searchTerms(search string) []string {
+	return strings.FieldsFunc(search, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+}
+
+// ftsQuery turns a search into an FTS5 query that matches bookmarks containing
+// every term, or a word starting with it. Each term is quoted so that nothing
+// the user types is taken as query syntax.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.Replace(term, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// likePattern returns a LIKE pattern matching text containing term
+func likePattern(term string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + escaper.Replace(term) + "%"
+}
+
+// highlightSnippet escapes a snippet containing match markers as HTML, with
+// the matches wrapped in <mark> tags
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.Replace(snippet, snippetMatchStart, "<mark>", -1)
+	return strings.Replace(snippet, snippetMatchEnd, "</mark>", -1)
+}
+
+// buildSnippet is used when the database can't build snippets itself. It
+// finds the first of texts containing one of the terms and marks the matches
+// in a window of words around the first one.
+func buildSnippet(texts []string, terms []string) string {
+	for _, text := range texts {
+		words := strings.Fields(text)
+		first := -1
+		marked := make([]string, len(words))
+		for i, word := range words {
+			marked[i] = markTerms(word, terms)
+			if first < 0 && marked[i] != word {
+				first = i
+			}
+		}
+		if first < 0 {
+			continue
+		}
+
+		start := first - snippetWords/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + snippetWords
+		if end > len(words) {
+			// near the end, so show more of what comes before
+			end = len(words)
+			if start = end - snippetWords; start < 0 {
+				start = 0
+			}
+		}
+		snippet := strings.Join(marked[start:end], " ")
+		if start > 0 {
+			snippet = snippetEllipsis + snippet
+		}
+		if end < len(words) {
+			snippet += snippetEllipsis
+		}
+		return snippet
+	}
+
+	return ""
+}
+
+// markTerms puts match markers around every case-insensitive occurrence of
+// the terms in word
+func markTerms(word string, terms []string) string {
+	var marked strings.Builder
+	for i := 0; i < len(word); {
+		matched := 0
+		for _, term := range terms {
+			if n := len(term); n > matched && i+n <= len(word) && strings.EqualFold(word[i:i+n], term) {
+				matched = n
+			}
+		}
+		if matched == 0 {
+			marked.WriteByte(word[i])
+			i++
+			continue
+		}
+		marked.WriteString(snippetMatchStart + word[i:i+matched] + snippetMatchEnd)
+		i += matched
+	}
+
+	return marked.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestFTSQuery(t *testing.T) {
+	terms := searchTerms(`propane "accessories" AND-hank's`)
+	if len(terms) != 5 {
+		t.Fatalf("unexpected terms %q", terms)
+	}
+	// nothing the user types should be taken as FTS5 syntax
+	expected := `"propane"* "accessories"* "AND"* "hank"* "s"*`
+	if q := ftsQuery(terms); q != expected {
+		t.Fatalf("expected %s, found %s", expected, q)
+	}
+}
+
+func TestBuildSnippet(t *testing.T) {
+	texts := []string{
+		"Strickland Propane",
+		"Taste the meat, not the heat. We sell propane and propane accessories to the good people of Arlen, Texas.",
+	}
+	snippet := highlightSnippet(buildSnippet(texts, []string{"accessories"}))
+	expected := "…sell propane and propane <mark>accessories</mark> to the good people of Arlen, Texas."
+	if snippet != expected {
+		t.Fatalf("expected %q, found %q", expected, snippet)
+	}
+
+	// the first text with a match is used, and matches ignore case
+	snippet = highlightSnippet(buildSnippet(texts, []string{"PROP"}))
+	if snippet != "Strickland <mark>Prop</mark>ane" {
+		t.Fatalf("unexpected snippet %q", snippet)
+	}
+
+	if snippet = buildSnippet(texts, []string{"charcoal"}); snippet != "" {
+		t.Fatalf("expected no snippet, found %q", snippet)
+	}
+}
+
+func TestHighlightSnippetEscapes(t *testing.T) {
+	snippet := highlightSnippet(buildSnippet([]string{"<script>alert(1)</script>"}, []string{"alert"}))
+	if snippet != "&lt;script&gt;<mark>alert</mark>(1)&lt;/script&gt;" {
+		t.Fatalf("the snippet wasn't escaped: %q", snippet)
+	}
+}
@@ -2,21 +2,43 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // Bookmark represents a bookmark
 type Bookmark struct {
-	ID      *int64  `json:"id,omitempty"db:"id"`
-	URL     *string `json:"url,omitempty"db:"url"`
-	Title   *string `json:"title,omitempty"db:"title"`
-	OwnerID *int64  `json:"owner_id,omitempty"db:"owner_id"`
+	ID           *int64     `json:"id,omitempty"db:"id"`
+	URL          *string    `json:"url,omitempty"db:"url"`
+	Title        *string    `json:"title,omitempty"db:"title"`
+	FolderID     *int64     `json:"folder_id,omitempty"db:"folder_id"`
+	Position     *int       `json:"position,omitempty"db:"position"`
+	Description  *string    `json:"description,omitempty"db:"description"`
+	Tags         []string   `json:"tags,omitempty"db:"-"`
+	CreationDate *time.Time `json:"creation_date,omitempty"db:"creation_date"`
+	FaviconURL   *string    `json:"favicon_url,omitempty"db:"favicon_url"`
+	CanonicalURL *string    `json:"canonical_url,omitempty"db:"canonical_url"`
+	// MetadataPending is set until the bookmark's page has been fetched
+	MetadataPending *bool  `json:"metadata_pending,omitempty"db:"metadata_pending"`
+	OwnerID         *int64 `json:"owner_id,omitempty"db:"owner_id"`
+	// Rank is how well the bookmark matched a search, higher being better
+	Rank *float64 `json:"rank,omitempty"db:"rank"`
+	// Snippet is the part of the bookmark that matched a search, as HTML with
+	// the matching words in <mark> tags
+	Snippet *string `json:"snippet,omitempty"db:"snippet"`
 }
 
+// errBookmarkNotFound is returned when a bookmark doesn't exist or belongs to
+// someone else
+var errBookmarkNotFound = errors.New("bookmark not found")
+
 func (b Bookmark) String() string {
 	buf, _ := json.MarshalIndent(b, "", " ")
 	return string(buf)
@@ -54,6 +76,9 @@ func parseBookmarkID(w http.ResponseWriter, r *http.Request) (int64, bool) {
 }
 
 // CreateBookmarkHandler handles POST /bookmarks
+//
+// If there's no 'title', the bookmark's page is fetched in the background to
+// fill in its title, description, favicon and canonical url.
 func CreateBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := authenticate(w, r)
 	if !ok {
@@ -74,30 +99,50 @@ func CreateBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	bookmark.OwnerID = &userID
+	if bookmark.Tags, err = cleanTags(bookmark.Tags); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
 
 	id, err := db().CreateBookmark(bookmark)
+	if err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+	notifyMetadataFetcher()
+
+	// pick up the position it was given
+	bookmark, err = db().Bookmark(id, userID)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
-	bookmark.ID = &id
 	sendSuccess(w, bookmark)
 }
 
 // GetBookmarksHandler handles GET /bookmarks
+//
+// The results can be filtered with one or more 'tag' parameters. By default a
+// bookmark needs every tag to match, or any of them with 'tag_mode=any'. With
+// 'q', only bookmarks whose url, title or description contain every word of
+// it are returned, best match first, each with a rank and a snippet.
 func GetBookmarksHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := authenticate(w, r)
 	if !ok {
 		return
 	}
 
-	page, pageSize, err := pageAndSize(r.URL.Query(), 10)
+	q, err := parseBookmarkQuery(r.URL.Query(), userID)
 	if err != nil {
 		sendBadReq(w, err.Error())
 		return
 	}
 
-	bookmarks, err := db().Bookmarks(userID, pageSize, page)
+	bookmarks, err := db().Bookmarks(q)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
 	sendSuccess(w, bookmarks)
 }
 
@@ -119,7 +164,7 @@ func GetBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if *bookmark.OwnerID != userID {
+	if bookmark == nil {
 		sendNotFound(w, "bookmark not found")
 		return
 	}
@@ -144,10 +189,11 @@ func EditBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 		sendInternalErr(w, err)
 		return
 	}
-	if *bookmark.OwnerID != userID {
+	if bookmark == nil {
 		sendNotFound(w, "bookmark not found")
 		return
 	}
+	folderID, position, creationDate := bookmark.FolderID, bookmark.Position, bookmark.CreationDate
 
 	dec := json.NewDecoder(r.Body)
 	if err = dec.Decode(bookmark); err != nil {
@@ -155,8 +201,20 @@ func EditBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if bookmark.URL == nil {
+		sendBadReq(w, "You need to provide a 'url'")
+		return
+	}
+
 	bookmark.ID = &bookmarkID // to make sure they didn't try to replace the id
 	bookmark.OwnerID = &userID
+	// bookmarks are moved with POST /bookmarks/{bookmark_id}/move
+	bookmark.FolderID, bookmark.Position = folderID, position
+	bookmark.CreationDate = creationDate
+	if bookmark.Tags, err = cleanTags(bookmark.Tags); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
 	if err = db().EditBookmark(bookmark); err != nil {
 		sendInternalErr(w, err)
 		return
@@ -184,3 +242,157 @@ func DeleteBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
 	sendSuccess(w, nil)
 }
+
+// maxBookmarkImportBytes limits the size of an uploaded bookmark file
+const maxBookmarkImportBytes = 32 << 20
+
+// bookmarkImportResult reports what was added by an import
+type bookmarkImportResult struct {
+	Folders   int `json:"folders"`
+	Bookmarks int `json:"bookmarks"`
+	Skipped   int `json:"skipped"`
+}
+
+func countBookmarkTree(folders []*BookmarkFolderNode, bookmarks []*Bookmark, result *bookmarkImportResult) {
+	result.Folders += len(folders)
+	result.Bookmarks += len(bookmarks)
+	for _, node := range folders {
+		countBookmarkTree(node.Folders, node.Bookmarks, result)
+	}
+}
+
+// ImportBookmarksHandler handles POST /bookmarks/import
+//
+// The upload is a browser's Netscape format bookmarks.html, either as the
+// 'file' field of a multipart form or as the request body. Its folders and
+// bookmarks are added after everything already in the folder given by the
+// optional 'folder_id' parameter, or the top level.
+func ImportBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var folderID *int64
+	if str := r.URL.Query().Get("folder_id"); str != "" {
+		id, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			sendBadReq(w, "invalid folder id")
+			return
+		}
+		folderID = &id
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBookmarkImportBytes)
+	var upload io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			sendBadReq(w, fmt.Sprintf("unable to read the uploaded file (it must be smaller than %d bytes)", maxBookmarkImportBytes))
+			return
+		}
+		defer file.Close()
+		upload = file
+	}
+
+	tree, skipped, err := parseNetscapeBookmarks(upload)
+	if err != nil {
+		sendBadReq(w, fmt.Sprintf("unable to parse the bookmark file: %v", err))
+		return
+	}
+
+	if err = db().ImportBookmarks(userID, folderID, tree); err != nil {
+		sendFolderErr(w, err)
+		return
+	}
+	notifyMetadataFetcher()
+
+	result := bookmarkImportResult{Skipped: skipped}
+	countBookmarkTree(tree.Folders, tree.Bookmarks, &result)
+	sendSuccess(w, result)
+}
+
+// ExportBookmarksHandler handles GET /bookmarks/export
+//
+// It returns all of the user's bookmarks as a Netscape format bookmarks.html
+// that any browser can import.
+func ExportBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	tree, _, err := loadBookmarkTree(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.html"`)
+	if err = writeNetscapeBookmarks(w, tree); err != nil {
+		logErr(NewtonErr(err))
+	}
+}
+
+// RefreshBookmarkMetadataHandler handles POST /bookmarks/{bookmark_id}/metadata
+//
+// It queues the bookmark's page to be fetched again. The favicon and canonical
+// url are replaced, but the title and description are only filled in if
+// they're empty.
+func RefreshBookmarkMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	bookmarkID, ok := parseBookmarkID(w, r)
+	if !ok {
+		return
+	}
+
+	if gMetadataFetcher == nil {
+		sendBadReq(w, "fetching bookmark metadata is turned off")
+		return
+	}
+	err := db().RequestBookmarkMetadata(bookmarkID, userID)
+	if err == errBookmarkNotFound {
+		sendNotFound(w, "bookmark not found")
+		return
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	notifyMetadataFetcher()
+
+	sendSuccess(w, nil)
+}
+
+// GetBookmarkSnapshotHandler handles GET /bookmarks/{bookmark_id}/snapshot
+//
+// It returns the readable text saved from the bookmark's page, which is only
+// kept when NEWTON_STORE_SNAPSHOTS is set.
+func GetBookmarkSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	bookmarkID, ok := parseBookmarkID(w, r)
+	if !ok {
+		return
+	}
+
+	snapshot, err := db().BookmarkSnapshot(bookmarkID, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if snapshot == nil {
+		sendNotFound(w, "snapshot not found")
+		return
+	}
+
+	sendSuccess(w, snapshot)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loadConfig reads the optional settings from the environment. Anything that
+// isn't set keeps its default value.
+func loadConfig() error {
+	var err error
+	if gAllowQueryAccessToken, err = envBool("NEWTON_ALLOW_QUERY_TOKEN", gAllowQueryAccessToken); err != nil {
+		return err
+	}
+	if key := os.Getenv("NEWTON_TOKEN_KEY"); key != "" {
+		gTokenKey = []byte(key)
+	} else {
+		log.Print("NEWTON_TOKEN_KEY is not set; access tokens will be hashed without a key")
+	}
+	if gSessionIdleTimeout, err = envDuration("NEWTON_SESSION_IDLE_TIMEOUT", gSessionIdleTimeout); err != nil {
+		return err
+	}
+	if gSessionMaxAge, err = envDuration("NEWTON_SESSION_MAX_AGE", gSessionMaxAge); err != nil {
+		return err
+	}
+	if gAccessTokenLifetime, err = envDuration("NEWTON_ACCESS_TOKEN_LIFETIME", gAccessTokenLifetime); err != nil {
+		return err
+	}
+	if gAccessTokenLifetime == 0 {
+		return errors.New("NEWTON_ACCESS_TOKEN_LIFETIME must be greater than 0")
+	}
+	if gBcryptCost, err = envInt("NEWTON_BCRYPT_COST", gBcryptCost); err != nil {
+		return err
+	}
+	if gBcryptCost < bcrypt.MinCost || gBcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("NEWTON_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if gPasswordResetLifetime, err = envDuration("NEWTON_PASSWORD_RESET_LIFETIME", gPasswordResetLifetime); err != nil {
+		return err
+	}
+	gPasswordResetURL = os.Getenv("NEWTON_PASSWORD_RESET_URL")
+	if gMailer, err = loadMailer(); err != nil {
+		return err
+	}
+	if gFetchMetadata, err = envBool("NEWTON_FETCH_METADATA", gFetchMetadata); err != nil {
+		return err
+	}
+	if gFetchTimeout, err = envDuration("NEWTON_FETCH_TIMEOUT", gFetchTimeout); err != nil {
+		return err
+	}
+	if gFetchTimeout == 0 {
+		return errors.New("NEWTON_FETCH_TIMEOUT must be greater than 0")
+	}
+	if gFetchMaxBytes, err = envInt("NEWTON_FETCH_MAX_BYTES", gFetchMaxBytes); err != nil {
+		return err
+	}
+	if gFetchMaxBytes <= 0 {
+		return errors.New("NEWTON_FETCH_MAX_BYTES must be greater than 0")
+	}
+	if gStoreSnapshots, err = envBool("NEWTON_STORE_SNAPSHOTS", gStoreSnapshots); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadMailer picks the mailer to use. SMTP takes precedence over writing
+// emails to a directory, and if neither is configured there's no mailer.
+func loadMailer() (Mailer, error) {
+	if from := os.Getenv("NEWTON_MAIL_FROM"); from != "" {
+		gMailFrom = from
+	}
+	if addr := os.Getenv("NEWTON_SMTP_ADDR"); addr != "" {
+		return newSMTPMailer(addr, os.Getenv("NEWTON_SMTP_USERNAME"), os.Getenv("NEWTON_SMTP_PASSWORD"), gMailFrom)
+	}
+	if dir := os.Getenv("NEWTON_MAIL_DIR"); dir != "" {
+		return fileMailer{dir: dir, from: gMailFrom}, nil
+	}
+
+	log.Print("neither NEWTON_SMTP_ADDR nor NEWTON_MAIL_DIR is set; password resets are turned off")
+	return nil, nil
+}
+
+func envBool(name string, defaultVal bool) (bool, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultVal, nil
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		return defaultVal, fmt.Errorf("%s must be a boolean, found '%s'", name, str)
+	}
+
+	return val, nil
+}
+
+func envInt(name string, defaultVal int) (int, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultVal, nil
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return defaultVal, fmt.Errorf("%s must be an integer, found '%s'", name, str)
+	}
+
+	return val, nil
+}
+
+func envDuration(name string, defaultVal time.Duration) (time.Duration, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultVal, nil
+	}
+	val, err := time.ParseDuration(str)
+	if err != nil || val < 0 {
+		return defaultVal, fmt.Errorf("%s must be a non-negative duration (e.g. '720h'), found '%s'", name, str)
+	}
+
+	return val, nil
+}
@@ -1,24 +1,65 @@
 package main
 
+import "time"
+
 var gDatabase NewtonDB
 
 // NewtonDB is an abstraction of all the methods necessary for a database provider to implement
 type NewtonDB interface {
 	Bookmark(bookmarkID, ownerID int64) (*Bookmark, error)
 	BookmarkExists(id int64) (bool, error)
-	Bookmarks(ownerID int64, pageSize int, page int) ([]*Bookmark, error)
+	Bookmarks(q *BookmarkQuery) ([]*Bookmark, error)
 	CreateBookmark(bookmark *Bookmark) (int64, error)
 	DeleteBookmark(bookmarkID, ownerID int64) error
 	EditBookmark(bookmark *Bookmark) error
+	MoveBookmark(bookmarkID, ownerID int64, folderID *int64, position int) error
+
+	BookmarkFolder(folderID, ownerID int64) (*BookmarkFolder, error)
+	BookmarkFolders(ownerID int64) ([]*BookmarkFolder, error)
+	CreateBookmarkFolder(folder *BookmarkFolder) (int64, error)
+	EditBookmarkFolder(folder *BookmarkFolder) error
+	MoveBookmarkFolder(folderID, ownerID int64, parentID *int64, position int) error
+	DeleteBookmarkFolder(folderID, ownerID int64) error
+	ImportBookmarks(ownerID int64, folderID *int64, tree *BookmarkTree) error
+	BookmarksPendingMetadata(limit int) ([]*Bookmark, error)
+	RequestBookmarkMetadata(bookmarkID, ownerID int64) error
+	SetBookmarkMetadata(bookmarkID int64, meta *PageMetadata) error
+	BookmarkSnapshot(bookmarkID, ownerID int64) (*BookmarkSnapshot, error)
+
+	Tags(ownerID int64) ([]*Tag, error)
+	MergeTags(ownerID int64, tagIDs []int64, name string) (*Tag, error)
 
 	User(id int64) (*User, error)
 	UserExists(id int64) (bool, error)
 	UserByUsername(username string) (*User, error)
+	UsersByEmail(email string) ([]*User, error)
 	CreateUser(user *User) (int64, error)
 	EditUser(user *User) error
+	SetUserPassword(userID int64, passwordHash string) error
+	DeleteUser(userID int64) error
 
 	CreateSession(session *Session) (int64, error)
-	SessionByAccessToken(token string) (*Session, error)
+	SessionByAccessTokenHash(hash string) (*Session, error)
+	SessionByRefreshTokenHash(hash string) (*Session, error)
+	SessionByRetiredRefreshTokenHash(hash string) (sessionID, userID int64, err error)
+	RotateSessionTokens(session *Session, oldRefreshTokenHash string) (bool, error)
+	Session(sessionID, userID int64) (*Session, error)
+	SessionsByUserID(userID int64) ([]*Session, error)
+	TouchSession(sessionID int64, lastUsed time.Time) error
+	DeleteSession(sessionID, userID int64) error
+	DeleteOtherSessions(userID, keepSessionID int64) error
+
+	CreatePasswordReset(reset *PasswordReset) error
+	PasswordResetUserID(tokenHash string, now time.Time) (int64, error)
+	ResetPassword(tokenHash, passwordHash string, now time.Time) (bool, error)
+
+	UserTOTP(userID int64) (*UserTOTP, error)
+	SetUserTOTP(totp *UserTOTP) error
+	ConfirmUserTOTP(userID, counter int64, recoveryCodeHashes []string) error
+	SetRecoveryCodes(userID int64, recoveryCodeHashes []string) error
+	UseTOTPCounter(userID, counter int64) (bool, error)
+	UseRecoveryCode(userID int64, recoveryCodeHash string) (bool, error)
+	DeleteUserTOTP(userID int64) error
 
 	CreateContact(contact *Contact) (int64, error)
 	ContactExists(id int64) (bool, error)
@@ -30,6 +71,9 @@ type NewtonDB interface {
 	ContactOwner(contactID int64) (int64, error)
 
 	AddLocationRecord(locRec *LocationRecord) error
+	AddLocationRecords(records []*LocationRecord, policy LocationConflictPolicy) (int, int, error)
+	LocationRecords(q *LocationQuery) ([]LocationRecord, error)
+	EachLocationRecord(q *LocationQuery, fn func(*LocationRecord) error) error
 }
 
 // InitDB initializes the database that backs the API
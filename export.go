@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// userExport is everything stored about a user, other than their location
+// history, which is streamed straight from the database
+type userExport struct {
+	user      *User
+	bookmarks *BookmarkTree
+	contacts  []*Contact
+	photos    map[int64][]byte
+}
+
+func loadUserExport(userID int64) (*userExport, error) {
+	user, err := db().User(userID)
+	if err != nil {
+		return nil, err
+	}
+	// the password hash isn't personal data worth handing out
+	user.Password = nil
+
+	bookmarks, _, err := loadBookmarkTree(userID)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := db().Contacts(userID)
+	if err != nil {
+		return nil, err
+	}
+	photos := make(map[int64][]byte)
+	for _, c := range contacts {
+		photo, err := db().ContactPhoto(*c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(photo) > 0 {
+			photos[*c.ID] = photo
+		}
+	}
+
+	return &userExport{user: user, bookmarks: bookmarks, contacts: contacts, photos: photos}, nil
+}
+
+// photoExtension guesses a file extension for an image
+func photoExtension(photo []byte) string {
+	exts, _ := mime.ExtensionsByType(http.DetectContentType(photo))
+	for _, ext := range exts {
+		switch ext {
+		case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp":
+			return ext
+		}
+	}
+	return ".bin"
+}
+
+// writeUserExport writes the user's data out as a zip archive
+func writeUserExport(w io.Writer, export *userExport) error {
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	create := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+	writeJSON := func(name string, v interface{}) error {
+		f, err := create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	if err := writeJSON("profile.json", export.user); err != nil {
+		return err
+	}
+
+	if err := writeJSON("bookmarks.json", export.bookmarks); err != nil {
+		return err
+	}
+	f, err := create("bookmarks.html")
+	if err != nil {
+		return err
+	}
+	if err = writeNetscapeBookmarks(f, export.bookmarks); err != nil {
+		return err
+	}
+
+	if err = writeJSON("contacts.json", export.contacts); err != nil {
+		return err
+	}
+	f, err = create("contacts.vcf")
+	if err != nil {
+		return err
+	}
+	vw := newVCardWriter(f)
+	for _, c := range export.contacts {
+		if err = vw.writeContact(c, export.photos[*c.ID]); err != nil {
+			return err
+		}
+	}
+	for _, c := range export.contacts {
+		photo, ok := export.photos[*c.ID]
+		if !ok {
+			continue
+		}
+		f, err = create(fmt.Sprintf("contact_photos/%d%s", *c.ID, photoExtension(photo)))
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(f, bytes.NewReader(photo)); err != nil {
+			return err
+		}
+	}
+
+	f, err = create("locations.gpx")
+	if err != nil {
+		return err
+	}
+	gw, err := newGPXWriter(f, "Newton location history")
+	if err != nil {
+		return err
+	}
+	q := NewLocationQuery(*export.user.ID)
+	q.Ascending = true
+	if err = db().EachLocationRecord(q, gw.writeRecord); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// ExportUserHandler handles GET /users/{user_id}/export
+//
+// It sends a zip archive of everything stored for the user: their profile,
+// bookmarks (as JSON and as a Netscape bookmark file), contacts (as JSON and
+// vCards), contact photos and location history (as GPX).
+func ExportUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseOwnUserID(w, r)
+	if !ok {
+		return
+	}
+
+	export, err := loadUserExport(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="newton-export-%s.zip"`, time.Now().Format("2006-01-02")))
+	if err = writeUserExport(w, export); err != nil {
+		// the response has already started, so all we can do is log it
+		logErr(NewtonErr(err))
+	}
+}
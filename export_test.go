@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestVCardWriter(t *testing.T) {
+	id := int64(7)
+	given, family := "Hank", "Hill"
+	note := "Sells propane; and propane accessories,\nin Arlen"
+	company := "Strickland Propane"
+	contact := &Contact{
+		ID:        &id,
+		Name:      &StructuredName{GivenName: &given, FamilyName: &family},
+		Emails:    []*Email{{Address: "hank@example.com", Type: EmailTypeWork}},
+		Phones:    []*Phone{{Number: "+1 214-555-1212", Type: PhoneTypeMobile}},
+		Org:       &Organization{Company: &company},
+		Relations: []*Relation{{Name: "Peggy Hill", Type: RelationTypeSpouse}},
+		Events:    []*Event{{StartDate: "1954-04-19", Type: EventTypeBirthday}},
+		Websites:  []string{"http://example.com/" + strings.Repeat("propane/", 20)},
+		Note:      &note,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := newVCardWriter(buf).writeContact(contact, imageData); err != nil {
+		t.Fatal(err)
+	}
+	card := buf.String()
+
+	for _, want := range []string{
+		"BEGIN:VCARD\r\nVERSION:4.0\r\n",
+		"UID:urn:newton:contact:7\r\n",
+		"FN:Hank Hill\r\n",
+		"N:Hill;Hank;;;\r\n",
+		"EMAIL;TYPE=work:hank@example.com\r\n",
+		"TEL;TYPE=cell:+1 214-555-1212\r\n",
+		"ORG:Strickland Propane\r\n",
+		"RELATED;VALUE=text;TYPE=spouse:Peggy Hill\r\n",
+		"BDAY:19540419\r\n",
+		`NOTE:Sells propane\; and propane accessories\,\nin Arlen` + "\r\n",
+		"PHOTO:data:image/png;base64,",
+		"END:VCARD\r\n",
+	} {
+		if !strings.Contains(card, want) {
+			t.Errorf("vCard is missing %q:\n%s", want, card)
+		}
+	}
+
+	for _, line := range strings.Split(card, "\r\n") {
+		if len(line) > 75 {
+			t.Fatalf("line wasn't folded: %q", line)
+		}
+	}
+	unfolded := strings.Replace(card, "\r\n ", "", -1)
+	if !strings.Contains(unfolded, "URL:"+contact.Websites[0]+"\r\n") {
+		t.Fatal("the folded url doesn't unfold to the original")
+	}
+}
+
+func TestWriteNetscapeBookmarks(t *testing.T) {
+	folderID, zero, one, two := int64(1), 0, 1, 2
+	title := "Propane"
+	folders := []*BookmarkFolder{{ID: &folderID, Title: &title, Position: &one}}
+	bookmarks := []*Bookmark{
+		NewBookmark("http://example.com/?a=1&b=2", "Tom & Jerry <3", 1),
+		NewBookmark("http://example.org", "", 1),
+		NewBookmark("http://example.net", "Nested", 1),
+	}
+	bookmarks[0].Position = &zero
+	bookmarks[1].Position = &two
+	bookmarks[2].FolderID = &folderID
+	buf := &bytes.Buffer{}
+	if err := writeNetscapeBookmarks(buf, buildBookmarkTree(folders, bookmarks)); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	if !strings.HasPrefix(out, "<!DOCTYPE NETSCAPE-Bookmark-file-1>") {
+		t.Fatal("missing the doctype")
+	}
+	if !strings.Contains(out, `<A HREF="http://example.com/?a=1&amp;b=2">Tom &amp; Jerry &lt;3</A>`) {
+		t.Fatalf("bookmark wasn't escaped:\n%s", out)
+	}
+	if !strings.Contains(out, `<A HREF="http://example.org">http://example.org</A>`) {
+		t.Fatalf("untitled bookmark should use its url as the title:\n%s", out)
+	}
+
+	// the folder sits between the two top level bookmarks
+	first := strings.Index(out, "http://example.com")
+	folder := strings.Index(out, "<H3>Propane</H3>")
+	nested := strings.Index(out, "http://example.net")
+	last := strings.Index(out, "http://example.org")
+	if !(first < folder && folder < nested && nested < last) {
+		t.Fatalf("bookmarks and folders are out of order:\n%s", out)
+	}
+	if strings.Count(out, "<DL><p>") != 2 || strings.Count(out, "</DL><p>") != 2 {
+		t.Fatalf("the folder's list wasn't nested:\n%s", out)
+	}
+}
+
+const firefoxBookmarks = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks Menu</H1>
+
+<DL><p>
+    <DT><A HREF="http://strickland.example/" ADD_DATE="1262304000" TAGS="propane,Work,propane">Strickland &amp; Sons</A>
+    <DD>Propane &amp; propane accessories
+    <DT><H3 ADD_DATE="1262304000" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks Toolbar</H3>
+    <DL><p>
+        <DT><A HREF="http://arlen.example/">Arlen</A>
+        <DT><H3>Empty</H3>
+        <DL><p>
+        </DL><p>
+        <DT><A>No link</A>
+    </DL><p>
+    <DT><A HREF="http://megalomart.example/">Mega Lo Mart</A>
+</DL><p>
+`
+
+func TestParseNetscapeBookmarks(t *testing.T) {
+	tree, skipped, err := parseNetscapeBookmarks(strings.NewReader(firefoxBookmarks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Fatalf("expected the bookmark without a link to be skipped, skipped %d", skipped)
+	}
+	if len(tree.Folders) != 1 || len(tree.Bookmarks) != 2 {
+		t.Fatalf("expected 1 folder and 2 bookmarks at the top, found %d and %d", len(tree.Folders), len(tree.Bookmarks))
+	}
+
+	first := tree.Bookmarks[0]
+	if *first.Title != "Strickland & Sons" || *first.Position != 0 {
+		t.Fatalf("unexpected first bookmark %v", first)
+	}
+	if first.CreationDate == nil || first.CreationDate.Unix() != 1262304000 {
+		t.Fatal("the ADD_DATE wasn't read")
+	}
+	if len(first.Tags) != 2 || first.Tags[0] != "propane" || first.Tags[1] != "Work" {
+		t.Fatalf("unexpected tags %v", first.Tags)
+	}
+	if first.Description == nil || *first.Description != "Propane & propane accessories" {
+		t.Fatal("the description wasn't read")
+	}
+	if tree.Folders[0].Bookmarks[0].Description != nil {
+		t.Fatal("only bookmarks followed by a <DD> have a description")
+	}
+	if *tree.Bookmarks[1].Position != 2 {
+		t.Fatal("the last bookmark should come after the toolbar")
+	}
+
+	toolbar := tree.Folders[0]
+	if *toolbar.Title != "Bookmarks Toolbar" || *toolbar.Position != 1 {
+		t.Fatalf("unexpected folder %q at %d", *toolbar.Title, *toolbar.Position)
+	}
+	if len(toolbar.Bookmarks) != 1 || *toolbar.Bookmarks[0].URL != "http://arlen.example/" {
+		t.Fatal("the toolbar's bookmark is missing")
+	}
+	if len(toolbar.Folders) != 1 || *toolbar.Folders[0].Title != "Empty" || len(toolbar.Folders[0].Bookmarks) != 0 {
+		t.Fatal("the empty folder is missing")
+	}
+
+	// what we write can be read back in
+	buf := &bytes.Buffer{}
+	if err = writeNetscapeBookmarks(buf, tree); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `ADD_DATE="1262304000" TAGS="propane,Work">Strickland &amp; Sons</A>
+    <DD>Propane &amp; propane accessories`) {
+		t.Fatalf("the date and tags weren't written:\n%s", buf.String())
+	}
+	reread, _, err := parseNetscapeBookmarks(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reread.Folders) != 1 || len(reread.Bookmarks) != 2 || len(reread.Folders[0].Folders) != 1 {
+		t.Fatal("the tree didn't survive being written and read back")
+	}
+}
+
+func TestUserExport(t *testing.T) {
+	instantiateDatabase()
+
+	userID, err := db().CreateUser(NewUser("connie", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db().CreateBookmark(NewBookmark("http://strickland.example", "Strickland Propane", userID)); err != nil {
+		t.Fatal(err)
+	}
+	given, family := "Kahn", "Souphanousinphone"
+	contactID, err := db().CreateContact(&Contact{OwnerID: &userID, Name: &StructuredName{GivenName: &given, FamilyName: &family}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db().SetContactPhoto(contactID, imageData); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		if err = db().AddLocationRecord(&LocationRecord{Timestamp: 1000 * i, Latitude: 32.7767, Longitude: -96.797, OwnerID: userID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export, err := loadUserExport(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.user.Password != nil {
+		t.Fatal("the password hash shouldn't be exported")
+	}
+	if len(export.contacts) != 1 || len(export.photos) != 1 {
+		t.Fatal("expected a contact with a photo to export")
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writeUserExport(buf, export); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+
+	for _, name := range []string{"profile.json", "bookmarks.json", "bookmarks.html", "contacts.json", "contacts.vcf", "locations.gpx"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("%s is missing from the export", name)
+		}
+	}
+	if !strings.Contains(files["profile.json"], "connie") {
+		t.Fatal("profile wasn't exported")
+	}
+	if !strings.Contains(files["bookmarks.html"], "Strickland Propane") {
+		t.Fatal("bookmarks weren't exported")
+	}
+	if strings.Count(files["contacts.vcf"], "BEGIN:VCARD") != 1 {
+		t.Fatal("the contact wasn't exported as a vCard")
+	}
+	if _, ok := files[fmt.Sprintf("contact_photos/%d.png", contactID)]; !ok {
+		t.Fatal("contact photo wasn't exported")
+	}
+	if strings.Count(files["locations.gpx"], "<trkpt") != 2 {
+		t.Fatal("location history wasn't exported")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+// sqliteFTS5 is whether the tests were built with FTS5, so that the full-text
+// search of bookmarks is what they cover. Without the sqlite_fts5 tag, the
+// LIKE fallback is tested instead; run "go test -tags sqlite_fts5" as well.
+const sqliteFTS5 = true
@@ -0,0 +1,93 @@
+package main
+
+import "math"
+
+// earthRadiusMeters is the mean radius of the Earth
+const earthRadiusMeters = 6371008.8
+
+// LocationBounds is a latitude/longitude bounding box. When MinLongitude is
+// greater than MaxLongitude the box crosses the antimeridian.
+type LocationBounds struct {
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+}
+
+// Contains reports whether the point lies inside the bounding box
+func (lb *LocationBounds) Contains(lat, lon float64) bool {
+	if lat < lb.MinLatitude || lat > lb.MaxLatitude {
+		return false
+	}
+	if lb.MinLongitude <= lb.MaxLongitude {
+		return lon >= lb.MinLongitude && lon <= lb.MaxLongitude
+	}
+	return lon >= lb.MinLongitude || lon <= lb.MaxLongitude
+}
+
+func degreesToRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radiansToDegrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// wrapLongitude brings a longitude, or a difference between two, that's gone
+// past the antimeridian back into [-180, 180]
+func wrapLongitude(lon float64) float64 {
+	if lon > 180 {
+		return lon - 360
+	} else if lon < -180 {
+		return lon + 360
+	}
+	return lon
+}
+
+// haversineDistance returns the great-circle distance in meters between two
+// points
+func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1Rad := degreesToRadians(lat1)
+	lat2Rad := degreesToRadians(lat2)
+	dLat := degreesToRadians(lat2 - lat1)
+	dLon := degreesToRadians(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1Rad)*math.Cos(lat2Rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// boundsAroundPoint returns the smallest bounding box that contains every
+// point within radius meters of (lat, lon)
+func boundsAroundPoint(lat, lon, radius float64) *LocationBounds {
+	latDelta := radiansToDegrees(radius / earthRadiusMeters)
+	bounds := &LocationBounds{
+		MinLatitude: lat - latDelta,
+		MaxLatitude: lat + latDelta,
+	}
+
+	// near the poles the circle covers every longitude
+	if bounds.MinLatitude <= -90 || bounds.MaxLatitude >= 90 {
+		bounds.MinLatitude = math.Max(bounds.MinLatitude, -90)
+		bounds.MaxLatitude = math.Min(bounds.MaxLatitude, 90)
+		bounds.MinLongitude = -180
+		bounds.MaxLongitude = 180
+		return bounds
+	}
+
+	lonDelta := radiansToDegrees(math.Asin(math.Min(1, math.Sin(radius/earthRadiusMeters)/math.Cos(degreesToRadians(lat)))))
+	if lonDelta >= 180 {
+		bounds.MinLongitude = -180
+		bounds.MaxLongitude = 180
+		return bounds
+	}
+	bounds.MinLongitude = lon - lonDelta
+	bounds.MaxLongitude = lon + lonDelta
+	if bounds.MinLongitude < -180 {
+		bounds.MinLongitude += 360
+	}
+	if bounds.MaxLongitude > 180 {
+		bounds.MaxLongitude -= 360
+	}
+
+	return bounds
+}
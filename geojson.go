@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// geoJSONChunkSize is the most positions in each of the LineStrings that a
+// track is split into, which bounds how many timestamps are held in memory
+const geoJSONChunkSize = 1000
+
+// geoJSONWriter streams location records out as a GeoJSON FeatureCollection
+// of LineStrings. The timestamp of each coordinate is written to the feature's
+// 'coordTimes' property, which is the convention used by most mapping tools.
+// As the properties can only be written once the coordinates are, the track
+// is split into features of at most geoJSONChunkSize positions, each starting
+// where the previous one ended.
+type geoJSONWriter struct {
+	w        *bufio.Writer
+	last     LocationRecord
+	records  int
+	features int
+	times    []int64
+	ownerID  int64
+}
+
+func newGeoJSONWriter(w io.Writer, ownerID int64) *geoJSONWriter {
+	return &geoJSONWriter{w: bufio.NewWriter(w), ownerID: ownerID}
+}
+
+func (gw *geoJSONWriter) writeCoordinate(rec *LocationRecord) {
+	gw.w.WriteByte('[')
+	gw.w.WriteString(strconv.FormatFloat(rec.Longitude, 'f', -1, 64))
+	gw.w.WriteByte(',')
+	gw.w.WriteString(strconv.FormatFloat(rec.Latitude, 'f', -1, 64))
+	gw.w.WriteByte(']')
+}
+
+func (gw *geoJSONWriter) writeRecord(rec *LocationRecord) error {
+	// a LineString needs at least two positions, so a feature isn't started
+	// until the record after the one it starts from shows up
+	switch {
+	case gw.records == 0:
+	case len(gw.times) == 0:
+		if gw.features == 0 {
+			gw.w.WriteString(`{"type":"FeatureCollection","features":[`)
+		} else {
+			gw.w.WriteByte(',')
+		}
+		gw.w.WriteString(`{"type":"Feature","geometry":{"type":"LineString","coordinates":[`)
+		gw.writeCoordinate(&gw.last)
+		gw.w.WriteByte(',')
+		gw.writeCoordinate(rec)
+		gw.times = append(gw.times, gw.last.Timestamp, rec.Timestamp)
+	default:
+		gw.w.WriteByte(',')
+		gw.writeCoordinate(rec)
+		gw.times = append(gw.times, rec.Timestamp)
+	}
+	gw.last = *rec
+	gw.records++
+
+	if len(gw.times) >= geoJSONChunkSize {
+		return gw.endFeature()
+	}
+	return nil
+}
+
+// endFeature finishes the LineString being written
+func (gw *geoJSONWriter) endFeature() error {
+	gw.w.WriteString(`]},"properties":`)
+	if err := gw.writeProperties(gw.times); err != nil {
+		return err
+	}
+	gw.w.WriteByte('}')
+	gw.features++
+	gw.times = gw.times[:0]
+	return nil
+}
+
+// Close finishes the FeatureCollection and flushes it to the underlying writer
+func (gw *geoJSONWriter) Close() error {
+	switch {
+	case gw.records == 0:
+		gw.w.WriteString(`{"type":"FeatureCollection","features":[]}`)
+	case gw.records == 1:
+		// only a single record, so emit a Point instead
+		gw.w.WriteString(`{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":`)
+		gw.writeCoordinate(&gw.last)
+		gw.w.WriteString(`},"properties":`)
+		if err := gw.writeProperties([]int64{gw.last.Timestamp}); err != nil {
+			return err
+		}
+		gw.w.WriteString(`}]}`)
+	default:
+		if len(gw.times) > 0 {
+			if err := gw.endFeature(); err != nil {
+				return err
+			}
+		}
+		gw.w.WriteString(`]}`)
+	}
+	gw.w.WriteByte('\n')
+
+	return gw.w.Flush()
+}
+
+func (gw *geoJSONWriter) writeProperties(timestamps []int64) error {
+	coordTimes := make([]string, len(timestamps))
+	for i, ts := range timestamps {
+		coordTimes[i] = locationTime(ts).Format(time.RFC3339Nano)
+	}
+	props := map[string]interface{}{
+		"owner_id":   gw.ownerID,
+		"coordTimes": coordTimes,
+	}
+
+	buf, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	_, err = gw.w.Write(buf)
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gpxHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="Newton" xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v2" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd">
+`
+
+// gpxWriter streams location records out as a single GPX 1.1 track
+type gpxWriter struct {
+	w *bufio.Writer
+}
+
+func newGPXWriter(w io.Writer, trackName string) (*gpxWriter, error) {
+	gw := &gpxWriter{w: bufio.NewWriter(w)}
+	gw.w.WriteString(gpxHeader)
+	gw.w.WriteString(" <trk>\n  <name>")
+	if err := xml.EscapeText(gw.w, []byte(trackName)); err != nil {
+		return nil, err
+	}
+	_, err := gw.w.WriteString("</name>\n  <trkseg>\n")
+	if err != nil {
+		return nil, err
+	}
+
+	return gw, nil
+}
+
+// writeRecord writes rec as a track point. The speed and bearing go in
+// Garmin's TrackPointExtension, which parseGPX reads back. GPX has nowhere to
+// put an accuracy in meters (hdop is unitless), so it isn't exported.
+func (gw *gpxWriter) writeRecord(rec *LocationRecord) error {
+	fmt.Fprintf(gw.w, "   <trkpt lat=\"%s\" lon=\"%s\">",
+		strconv.FormatFloat(rec.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(rec.Longitude, 'f', -1, 64))
+	if rec.Altitude != nil {
+		fmt.Fprintf(gw.w, "<ele>%s</ele>", strconv.FormatFloat(*rec.Altitude, 'f', -1, 64))
+	}
+	fmt.Fprintf(gw.w, "<time>%s</time>", rec.Time().Format(time.RFC3339Nano))
+	if rec.Source != nil {
+		gw.w.WriteString("<src>")
+		if err := xml.EscapeText(gw.w, []byte(*rec.Source)); err != nil {
+			return err
+		}
+		gw.w.WriteString("</src>")
+	}
+	if rec.Speed != nil || rec.Bearing != nil {
+		gw.w.WriteString("<extensions><gpxtpx:TrackPointExtension>")
+		if rec.Speed != nil {
+			fmt.Fprintf(gw.w, "<gpxtpx:speed>%s</gpxtpx:speed>", strconv.FormatFloat(*rec.Speed, 'f', -1, 64))
+		}
+		if rec.Bearing != nil {
+			fmt.Fprintf(gw.w, "<gpxtpx:course>%s</gpxtpx:course>", strconv.FormatFloat(*rec.Bearing, 'f', -1, 64))
+		}
+		gw.w.WriteString("</gpxtpx:TrackPointExtension></extensions>")
+	}
+	_, err := gw.w.WriteString("</trkpt>\n")
+	return err
+}
+
+// Close finishes the GPX document and flushes it to the underlying writer
+func (gw *gpxWriter) Close() error {
+	gw.w.WriteString("  </trkseg>\n </trk>\n</gpx>\n")
+	return gw.w.Flush()
+}
+
+// parseGPX reads the track, route and waypoints out of a GPX document. Points
+// without a timestamp can't be stored as location records, so they're counted
+// in skipped instead. Besides the position, the elevation and source of each
+// point are read, along with the speed and course from Garmin's
+// TrackPointExtension when present.
+func parseGPX(r io.Reader) (records []*LocationRecord, skipped int, err error) {
+	dec := xml.NewDecoder(r)
+	var current *LocationRecord
+	var element string
+	var hasTime bool
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			element = t.Name.Local
+			switch element {
+			case "trkpt", "rtept", "wpt":
+				current = &LocationRecord{}
+				hasTime = false
+				for _, attr := range t.Attr {
+					switch attr.Name.Local {
+					case "lat":
+						current.Latitude, err = strconv.ParseFloat(strings.TrimSpace(attr.Value), 64)
+					case "lon":
+						current.Longitude, err = strconv.ParseFloat(strings.TrimSpace(attr.Value), 64)
+					}
+					if err != nil {
+						return nil, 0, fmt.Errorf("invalid coordinate at offset %d", dec.InputOffset())
+					}
+				}
+			}
+		case xml.CharData:
+			if current == nil {
+				continue
+			}
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			switch element {
+			case "time":
+				ts, err := time.Parse(time.RFC3339Nano, text)
+				if err != nil {
+					return nil, 0, fmt.Errorf("invalid time at offset %d", dec.InputOffset())
+				}
+				current.Timestamp = ts.UnixNano() / int64(time.Millisecond)
+				hasTime = true
+			case "ele", "speed", "course":
+				val, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, 0, fmt.Errorf("invalid %s at offset %d", element, dec.InputOffset())
+				}
+				switch element {
+				case "ele":
+					current.Altitude = &val
+				case "speed":
+					current.Speed = &val
+				case "course":
+					current.Bearing = &val
+				}
+			case "src":
+				current.Source = &text
+			}
+		case xml.EndElement:
+			element = ""
+			switch t.Name.Local {
+			case "trkpt", "rtept", "wpt":
+				if current != nil && hasTime {
+					records = append(records, current)
+				} else {
+					skipped++
+				}
+				current = nil
+			}
+		}
+	}
+
+	return records, skipped, nil
+}
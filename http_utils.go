@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 // NewtonError is used to identify errors that occur when the API returns something
@@ -23,6 +25,8 @@ const (
 	ErrorNotFound
 	ErrorBadRequest
 	ErrorUnauthorized
+	ErrorTooManyRequests
+	ErrorConflict
 )
 
 func sendResponse(w http.ResponseWriter, response interface{}, httpCode int) {
@@ -84,6 +88,20 @@ func sendUnauthorized(w http.ResponseWriter, msg string) {
 	sendErr(w, msg, http.StatusUnauthorized, ErrorUnauthorized)
 }
 
+func sendConflict(w http.ResponseWriter, msg string) {
+	sendErr(w, msg, http.StatusConflict, ErrorConflict)
+}
+
+// sendTooManyRequests tells the client to wait retryAfter before trying again
+func sendTooManyRequests(w http.ResponseWriter, msg string, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	sendErr(w, msg, http.StatusTooManyRequests, ErrorTooManyRequests)
+}
+
 func pageAndSize(args url.Values, defaultPageSize int) (page, pageSize int, err error) {
 	page = 0
 	pageSize = defaultPageSize
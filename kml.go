@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kmlCoordinate is a position read out of a KML document
+type kmlCoordinate struct {
+	lat, lon float64
+	alt      *float64
+}
+
+func (kc kmlCoordinate) record(timestamp int64) *LocationRecord {
+	return &LocationRecord{Timestamp: timestamp, Latitude: kc.lat, Longitude: kc.lon, Altitude: kc.alt}
+}
+
+// parseKMLCoordinate parses a single "lon,lat[,alt]" (or, for gx:coord,
+// space separated "lon lat [alt]") KML tuple
+func parseKMLCoordinate(s string) (coord kmlCoordinate, err error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) < 2 {
+		return coord, fmt.Errorf("invalid coordinate '%s'", s)
+	}
+	coord.lon, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return coord, fmt.Errorf("invalid longitude '%s'", fields[0])
+	}
+	coord.lat, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return coord, fmt.Errorf("invalid latitude '%s'", fields[1])
+	}
+	if len(fields) > 2 {
+		alt, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return coord, fmt.Errorf("invalid altitude '%s'", fields[2])
+		}
+		coord.alt = &alt
+	}
+
+	return coord, nil
+}
+
+// parseKML reads timestamped positions out of a KML document. Both gx:Track
+// elements (pairs of <when> and <gx:coord>) and Placemarks with a <TimeStamp>
+// and a <Point> are supported. Positions without a time, such as the vertices
+// of a LineString, are counted in skipped.
+func parseKML(r io.Reader) (records []*LocationRecord, skipped int, err error) {
+	dec := xml.NewDecoder(r)
+
+	var element string
+	var inTrack, inPoint bool
+	var whens []int64
+	var coords []kmlCoordinate
+	var placemarkWhen *int64
+	var placemarkCoord *kmlCoordinate
+
+	flushTrack := func() {
+		n := len(whens)
+		if len(coords) < n {
+			n = len(coords)
+		}
+		for i := 0; i < n; i++ {
+			records = append(records, coords[i].record(whens[i]))
+		}
+		skipped += len(whens) + len(coords) - 2*n
+		whens = nil
+		coords = nil
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			element = t.Name.Local
+			switch element {
+			case "Track":
+				inTrack = true
+			case "Point":
+				inPoint = true
+			case "Placemark":
+				placemarkWhen = nil
+				placemarkCoord = nil
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			switch {
+			case element == "when":
+				ts, err := time.Parse(time.RFC3339Nano, text)
+				if err != nil {
+					return nil, 0, fmt.Errorf("invalid time '%s'", text)
+				}
+				ms := ts.UnixNano() / int64(time.Millisecond)
+				if inTrack {
+					whens = append(whens, ms)
+				} else {
+					placemarkWhen = &ms
+				}
+			case element == "coord" && inTrack:
+				coord, err := parseKMLCoordinate(text)
+				if err != nil {
+					return nil, 0, err
+				}
+				coords = append(coords, coord)
+			case element == "coordinates" && inPoint:
+				coord, err := parseKMLCoordinate(text)
+				if err != nil {
+					return nil, 0, err
+				}
+				placemarkCoord = &coord
+			case element == "coordinates":
+				// LineStrings, Polygons, etc. carry no timestamps
+				skipped += len(strings.Fields(text))
+			}
+		case xml.EndElement:
+			element = ""
+			switch t.Name.Local {
+			case "Track":
+				flushTrack()
+				inTrack = false
+			case "Point":
+				inPoint = false
+			case "Placemark":
+				if placemarkCoord != nil {
+					if placemarkWhen != nil {
+						records = append(records, placemarkCoord.record(*placemarkWhen))
+					} else {
+						skipped++
+					}
+				}
+				placemarkWhen = nil
+				placemarkCoord = nil
+			}
+		}
+	}
+
+	return records, skipped, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import "math"
+
+// Kinds of LocationSegment
+const (
+	LocationSegmentStay = "stay"
+	LocationSegmentTrip = "trip"
+)
+
+// LocationSegment summarizes a stretch of location history as either a stay in
+// one place or a trip between places. Times are in milliseconds since the Unix
+// epoch, durations are in milliseconds and distances are in meters. A stay's
+// start and end coordinates are both the center of the stay.
+type LocationSegment struct {
+	Type           string  `json:"type"`
+	Start          int64   `json:"start"`
+	End            int64   `json:"end"`
+	Duration       int64   `json:"duration"`
+	Distance       float64 `json:"distance"`
+	StartLatitude  float64 `json:"start_latitude"`
+	StartLongitude float64 `json:"start_longitude"`
+	EndLatitude    float64 `json:"end_latitude"`
+	EndLongitude   float64 `json:"end_longitude"`
+	NumRecords     int     `json:"num_records"`
+}
+
+// pathDistance returns the length in meters of the path through the records
+func pathDistance(records []LocationRecord) float64 {
+	distance := 0.0
+	for i := 1; i < len(records); i++ {
+		distance += haversineDistance(records[i-1].Latitude, records[i-1].Longitude, records[i].Latitude, records[i].Longitude)
+	}
+	return distance
+}
+
+// crossTrackDistance approximates the distance in meters from p to the line
+// segment a-b. Over the short distances involved in simplifying a track, an
+// equirectangular projection around a is accurate enough.
+func crossTrackDistance(p, a, b *LocationRecord) float64 {
+	cosLat := math.Cos(degreesToRadians(a.Latitude))
+	project := func(rec *LocationRecord) (x, y float64) {
+		dLon := wrapLongitude(rec.Longitude - a.Longitude)
+		x = degreesToRadians(dLon) * cosLat * earthRadiusMeters
+		y = degreesToRadians(rec.Latitude-a.Latitude) * earthRadiusMeters
+		return
+	}
+
+	px, py := project(p)
+	bx, by := project(b)
+	lengthSq := bx*bx + by*by
+	if lengthSq == 0 {
+		return math.Hypot(px, py)
+	}
+
+	t := (px*bx + py*by) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// simplifyLocationRecords reduces a track with the Douglas-Peucker algorithm,
+// keeping every point that is more than tolerance meters away from the
+// simplified path. The first and last records are always kept.
+func simplifyLocationRecords(records []LocationRecord, tolerance float64) []LocationRecord {
+	if len(records) < 3 {
+		return records
+	}
+
+	keep := make([]bool, len(records))
+	keep[0] = true
+	keep[len(records)-1] = true
+
+	// an explicit stack avoids deep recursion on long tracks
+	type span struct{ first, last int }
+	stack := []span{{0, len(records) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		maxDistance := 0.0
+		index := -1
+		for i := s.first + 1; i < s.last; i++ {
+			d := crossTrackDistance(&records[i], &records[s.first], &records[s.last])
+			if d > maxDistance {
+				maxDistance = d
+				index = i
+			}
+		}
+		if index != -1 && maxDistance > tolerance {
+			keep[index] = true
+			stack = append(stack, span{s.first, index}, span{index, s.last})
+		}
+	}
+
+	simplified := make([]LocationRecord, 0)
+	for i, rec := range records {
+		if keep[i] {
+			simplified = append(simplified, rec)
+		}
+	}
+
+	return simplified
+}
+
+func newLocationSegment(segmentType string, records []LocationRecord) *LocationSegment {
+	first := records[0]
+	last := records[len(records)-1]
+	return &LocationSegment{
+		Type:           segmentType,
+		Start:          first.Timestamp,
+		End:            last.Timestamp,
+		Duration:       last.Timestamp - first.Timestamp,
+		Distance:       pathDistance(records),
+		StartLatitude:  first.Latitude,
+		StartLongitude: first.Longitude,
+		EndLatitude:    last.Latitude,
+		EndLongitude:   last.Longitude,
+		NumRecords:     len(records),
+	}
+}
+
+// segmentLocationRecords splits chronologically ordered records into stays and
+// trips. A stay is a run of records that remain within stayRadius meters of the
+// first record of the run for at least minStayDuration milliseconds. Whatever
+// happens between two stays is a trip, which begins at the last record of the
+// previous stay and ends at the first record of the next one.
+func segmentLocationRecords(records []LocationRecord, stayRadius float64, minStayDuration int64) []*LocationSegment {
+	segments := make([]*LocationSegment, 0)
+	tripStart := 0
+	i := 0
+	for i < len(records) {
+		j := i + 1
+		for j < len(records) && haversineDistance(records[i].Latitude, records[i].Longitude, records[j].Latitude, records[j].Longitude) <= stayRadius {
+			j++
+		}
+
+		if records[j-1].Timestamp-records[i].Timestamp < minStayDuration {
+			i++
+			continue
+		}
+
+		if i > tripStart {
+			segments = append(segments, newLocationSegment(LocationSegmentTrip, records[tripStart:i+1]))
+		}
+
+		stay := newLocationSegment(LocationSegmentStay, records[i:j])
+		// longitudes are averaged relative to the first record, so that a
+		// stay on the antimeridian isn't centered on the other side of the
+		// world
+		var latSum, dLonSum float64
+		for _, rec := range records[i:j] {
+			latSum += rec.Latitude
+			dLonSum += wrapLongitude(rec.Longitude - records[i].Longitude)
+		}
+		stay.StartLatitude = latSum / float64(j-i)
+		stay.StartLongitude = wrapLongitude(records[i].Longitude + dLonSum/float64(j-i))
+		stay.EndLatitude = stay.StartLatitude
+		stay.EndLongitude = stay.StartLongitude
+		segments = append(segments, stay)
+
+		tripStart = j - 1
+		i = j
+	}
+
+	if tripStart < len(records)-1 {
+		segments = append(segments, newLocationSegment(LocationSegmentTrip, records[tripStart:]))
+	}
+
+	return segments
+}
@@ -1,16 +1,668 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// LocationRecord ...
+// LocationRecord is a single location fix reported by one of a user's devices.
+// Timestamp is the number of milliseconds since the Unix epoch. The remaining
+// details are optional, since not every provider reports them: Accuracy is the
+// horizontal accuracy in meters, Altitude is in meters above the WGS84
+// ellipsoid, Speed is in meters/second, Bearing is in degrees clockwise from
+// true north, and Source names the provider (e.g. "gps" or "network").
 type LocationRecord struct {
-	Timestamp int64   `json:"timestamp"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	OwnerID   int64   `json:"owner_id"db:"owner_id"`
+	Timestamp int64    `json:"timestamp"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Accuracy  *float64 `json:"accuracy,omitempty"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Speed     *float64 `json:"speed,omitempty"`
+	Bearing   *float64 `json:"bearing,omitempty"`
+	Source    *string  `json:"source,omitempty"`
+	OwnerID   int64    `json:"owner_id"db:"owner_id"`
 }
 
-// CreateLocationEntry handles POST /locations
-func CreateLocationEntry(w http.ResponseWriter, r *http.Request) {
+// LocationConflictPolicy determines what happens when a location record is
+// added for a timestamp that the owner already has a record for
+type LocationConflictPolicy int
 
+// Ways of resolving duplicate location records
+const (
+	LocationConflictSkip LocationConflictPolicy = iota
+	LocationConflictReplace
+)
+
+// maxLocationUploadBytes limits the size of a bulk location upload body
+const maxLocationUploadBytes = 32 << 20
+
+// maxLocationImportBytes limits the size of an uploaded GPX or KML file
+const maxLocationImportBytes = 64 << 20
+
+// maxLocationUploadRecords limits the number of records in a single bulk upload
+const maxLocationUploadRecords = 50000
+
+// locationUploadError describes why a record in a bulk upload was rejected
+type locationUploadError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// locationUploadResult is returned from a bulk location upload. Duplicates
+// are the records whose timestamp already had a record, and when they replace
+// it they're counted as Replaced and Accepted as well.
+type locationUploadResult struct {
+	Received   int                   `json:"received"`
+	Accepted   int                   `json:"accepted"`
+	Duplicates int                   `json:"duplicates"`
+	Replaced   int                   `json:"replaced"`
+	Rejected   int                   `json:"rejected"`
+	Errors     []locationUploadError `json:"errors,omitempty"`
+}
+
+// Time returns the record's timestamp as a time.Time in UTC
+func (lr *LocationRecord) Time() time.Time {
+	return locationTime(lr.Timestamp)
+}
+
+// locationTime converts a location record timestamp into a time.Time in UTC
+func locationTime(ts int64) time.Time {
+	return time.Unix(0, ts*int64(time.Millisecond)).UTC()
+}
+
+func (lr *LocationRecord) validate() error {
+	if lr.Timestamp < 0 {
+		return fmt.Errorf("invalid 'timestamp' %d", lr.Timestamp)
+	}
+	if lr.Latitude < -90 || lr.Latitude > 90 {
+		return fmt.Errorf("'latitude' must be between -90 and 90, found %v", lr.Latitude)
+	}
+	if lr.Longitude < -180 || lr.Longitude > 180 {
+		return fmt.Errorf("'longitude' must be between -180 and 180, found %v", lr.Longitude)
+	}
+	if lr.Accuracy != nil && *lr.Accuracy < 0 {
+		return fmt.Errorf("'accuracy' must not be negative, found %v", *lr.Accuracy)
+	}
+	if lr.Speed != nil && *lr.Speed < 0 {
+		return fmt.Errorf("'speed' must not be negative, found %v", *lr.Speed)
+	}
+	if lr.Bearing != nil && (*lr.Bearing < 0 || *lr.Bearing >= 360) {
+		return fmt.Errorf("'bearing' must be at least 0 and less than 360, found %v", *lr.Bearing)
+	}
+	if lr.Source != nil && len(*lr.Source) > 64 {
+		return errors.New("'source' must be at most 64 characters")
+	}
+
+	return nil
+}
+
+// decodeLocationRecords accepts either a single JSON object or an array of them
+func decodeLocationRecords(body []byte) ([]*LocationRecord, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		records := make([]*LocationRecord, 0)
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	record := &LocationRecord{}
+	if err := json.Unmarshal(body, record); err != nil {
+		return nil, err
+	}
+	return []*LocationRecord{record}, nil
+}
+
+// LocationQuery selects a subset of a user's location records. Since and Until
+// are exclusive bounds on the timestamp and are ignored when -1. A Limit or
+// MaxAccuracy of 0 means no limit. Records without a reported accuracy are
+// never filtered out by MaxAccuracy.
+type LocationQuery struct {
+	OwnerID     int64
+	Since       int64
+	Until       int64
+	Limit       uint64
+	Ascending   bool
+	Bounds      *LocationBounds
+	MaxAccuracy float64
+}
+
+// NewLocationQuery returns a query for all of a user's location records, most
+// recent first
+func NewLocationQuery(ownerID int64) *LocationQuery {
+	return &LocationQuery{OwnerID: ownerID, Since: -1, Until: -1}
+}
+
+// parseLocationQuery reads the 'since', 'until', 'limit', 'order' and
+// 'max_accuracy' query parameters used when retrieving location records
+func parseLocationQuery(r *http.Request, ownerID int64) (*LocationQuery, error) {
+	args := r.URL.Query()
+	q := NewLocationQuery(ownerID)
+	q.Limit = 1000
+
+	var err error
+	if args.Get("since") != "" {
+		q.Since, err = strconv.ParseInt(args.Get("since"), 10, 64)
+		if err != nil {
+			return nil, errors.New("unable to parse 'since'")
+		}
+	}
+	if args.Get("until") != "" {
+		q.Until, err = strconv.ParseInt(args.Get("until"), 10, 64)
+		if err != nil {
+			return nil, errors.New("unable to parse 'until'")
+		}
+	}
+	if args.Get("limit") != "" {
+		q.Limit, err = strconv.ParseUint(args.Get("limit"), 10, 64)
+		if err != nil {
+			return nil, errors.New("unable to parse 'limit'")
+		}
+	}
+	switch args.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return nil, fmt.Errorf("'order' must be 'asc' or 'desc', found '%s'", args.Get("order"))
+	}
+	q.MaxAccuracy, err = parsePositiveFloat(r, "max_accuracy", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// parseTrackQuery is like parseLocationQuery, but for the endpoints that work
+// on a complete, chronological track, so 'limit' and 'order' are ignored
+func parseTrackQuery(r *http.Request, ownerID int64) (*LocationQuery, error) {
+	q, err := parseLocationQuery(r, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = 0
+	q.Ascending = true
+
+	return q, nil
+}
+
+// errStopIteration is returned from an EachLocationRecord callback to end the
+// iteration early
+var errStopIteration = errors.New("stop iteration")
+
+// locationArea restricts a location query to a bounding box, or to a circle
+// when radius is greater than zero
+type locationArea struct {
+	bounds    *LocationBounds
+	latitude  float64
+	longitude float64
+	radius    float64
+}
+
+func (la *locationArea) contains(rec *LocationRecord) bool {
+	if la.radius > 0 {
+		return haversineDistance(la.latitude, la.longitude, rec.Latitude, rec.Longitude) <= la.radius
+	}
+	return la.bounds.Contains(rec.Latitude, rec.Longitude)
+}
+
+// parseLocationArea reads either a bounding box ('min_lat', 'min_lon',
+// 'max_lat', 'max_lon') or a circle ('lat', 'lon' and 'radius' in meters) from
+// the query parameters. It returns nil if neither was specified.
+func parseLocationArea(r *http.Request) (*locationArea, error) {
+	args := r.URL.Query()
+	parse := func(name string, min, max float64) (float64, error) {
+		val, err := strconv.ParseFloat(args.Get(name), 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return 0, fmt.Errorf("unable to parse '%s'", name)
+		}
+		if val < min || val > max {
+			return 0, fmt.Errorf("'%s' must be between %v and %v", name, min, max)
+		}
+		return val, nil
+	}
+
+	hasBox := args.Get("min_lat") != "" || args.Get("min_lon") != "" || args.Get("max_lat") != "" || args.Get("max_lon") != ""
+	hasCircle := args.Get("lat") != "" || args.Get("lon") != "" || args.Get("radius") != ""
+	switch {
+	case hasBox && hasCircle:
+		return nil, errors.New("specify either a bounding box or a radius, not both")
+	case hasBox:
+		bounds := &LocationBounds{}
+		var err error
+		if bounds.MinLatitude, err = parse("min_lat", -90, 90); err != nil {
+			return nil, err
+		}
+		if bounds.MinLongitude, err = parse("min_lon", -180, 180); err != nil {
+			return nil, err
+		}
+		if bounds.MaxLatitude, err = parse("max_lat", -90, 90); err != nil {
+			return nil, err
+		}
+		if bounds.MaxLongitude, err = parse("max_lon", -180, 180); err != nil {
+			return nil, err
+		}
+		if bounds.MinLatitude > bounds.MaxLatitude {
+			return nil, errors.New("'min_lat' must not be greater than 'max_lat'")
+		}
+		return &locationArea{bounds: bounds}, nil
+	case hasCircle:
+		area := &locationArea{}
+		var err error
+		if area.latitude, err = parse("lat", -90, 90); err != nil {
+			return nil, err
+		}
+		if area.longitude, err = parse("lon", -180, 180); err != nil {
+			return nil, err
+		}
+		if area.radius, err = parse("radius", 0, math.MaxFloat64); err != nil {
+			return nil, err
+		}
+		if area.radius == 0 {
+			return nil, errors.New("'radius' must be greater than 0")
+		}
+		area.bounds = boundsAroundPoint(area.latitude, area.longitude, area.radius)
+		return area, nil
+	}
+
+	return nil, nil
+}
+
+// CreateLocationRecordsHandler handles POST /locations
+func CreateLocationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLocationUploadBytes))
+	if err != nil {
+		sendBadReq(w, fmt.Sprintf("the request body must be smaller than %d bytes", maxLocationUploadBytes))
+		return
+	}
+	records, err := decodeLocationRecords(body)
+	if err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	if len(records) == 0 {
+		sendBadReq(w, "You need to provide at least one location record")
+		return
+	}
+
+	for i, record := range records {
+		if record == nil {
+			sendBadReq(w, fmt.Sprintf("record %d is null", i))
+			return
+		}
+		if err = record.validate(); err != nil {
+			sendBadReq(w, fmt.Sprintf("record %d: %v", i, err))
+			return
+		}
+		record.OwnerID = userID
+	}
+
+	// a resent record is silently ignored, so clients can retry safely
+	if _, _, err = db().AddLocationRecords(records, LocationConflictSkip); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, records)
+}
+
+// BulkCreateLocationRecordsHandler handles POST /locations/bulk
+//
+// Every valid record is inserted in a single transaction. Invalid records are
+// rejected individually rather than failing the whole upload, and records
+// whose timestamp already exists are skipped, or replaced when the request
+// specifies 'on_conflict=replace'.
+func BulkCreateLocationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	policy := LocationConflictSkip
+	switch r.URL.Query().Get("on_conflict") {
+	case "", "skip":
+	case "replace":
+		policy = LocationConflictReplace
+	default:
+		sendBadReq(w, "'on_conflict' must be 'skip' or 'replace'")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLocationUploadBytes))
+	if err != nil {
+		sendBadReq(w, fmt.Sprintf("the request body must be smaller than %d bytes", maxLocationUploadBytes))
+		return
+	}
+	records, err := decodeLocationRecords(body)
+	if err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	if len(records) > maxLocationUploadRecords {
+		sendBadReq(w, fmt.Sprintf("a single upload may contain at most %d records", maxLocationUploadRecords))
+		return
+	}
+
+	result := locationUploadResult{Received: len(records)}
+	valid := make([]*LocationRecord, 0, len(records))
+	for i, record := range records {
+		if record == nil {
+			result.Errors = append(result.Errors, locationUploadError{Index: i, Error: "record is null"})
+			continue
+		}
+		if err = record.validate(); err != nil {
+			result.Errors = append(result.Errors, locationUploadError{Index: i, Error: err.Error()})
+			continue
+		}
+		record.OwnerID = userID
+		valid = append(valid, record)
+	}
+	result.Rejected = len(result.Errors)
+
+	inserted, duplicates, err := db().AddLocationRecords(valid, policy)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	result.Accepted = inserted
+	result.Duplicates = duplicates
+	if policy == LocationConflictReplace {
+		result.Accepted += duplicates
+		result.Replaced = duplicates
+	}
+
+	sendSuccess(w, result)
+}
+
+// GetLocationRecordsHandler handles GET /locations
+//
+// Besides the time range, results can be restricted to a bounding box or to a
+// radius around a point (see parseLocationArea), and fixes less accurate than
+// 'max_accuracy' meters can be left out.
+func GetLocationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseLocationQuery(r, userID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	area, err := parseLocationArea(r)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+	if area == nil {
+		records, err := db().LocationRecords(q)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		sendSuccess(w, records)
+		return
+	}
+
+	// the limit has to be applied after filtering by distance
+	limit := q.Limit
+	q.Limit = 0
+	q.Bounds = area.bounds
+	records := make([]LocationRecord, 0)
+	err = db().EachLocationRecord(q, func(rec *LocationRecord) error {
+		if !area.contains(rec) {
+			return nil
+		}
+		records = append(records, *rec)
+		if limit > 0 && uint64(len(records)) >= limit {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, records)
+}
+
+// sniffLocationFormat returns the name of the root element of an XML document
+// (e.g. "gpx" or "kml")
+func sniffLocationFormat(data []byte) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return strings.ToLower(start.Name.Local), nil
+		}
+	}
+}
+
+// readLocationImport returns the contents of the uploaded file, which can
+// either be the 'file' field of a multipart form or the raw request body
+func readLocationImport(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLocationImportBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(file)
+	}
+
+	return ioutil.ReadAll(r.Body)
+}
+
+// ImportLocationRecordsHandler handles POST /locations/import
+//
+// The upload may be a GPX or KML document. Points that already exist for the
+// user are skipped, so importing the same file twice is harmless.
+func ImportLocationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := readLocationImport(w, r)
+	if err != nil {
+		sendBadReq(w, fmt.Sprintf("unable to read the uploaded file (it must be smaller than %d bytes)", maxLocationImportBytes))
+		return
+	}
+
+	format, err := sniffLocationFormat(data)
+	if err != nil {
+		sendBadReq(w, "the uploaded file is not a GPX or KML document")
+		return
+	}
+
+	var records []*LocationRecord
+	var skipped int
+	switch format {
+	case "gpx":
+		records, skipped, err = parseGPX(bytes.NewReader(data))
+	case "kml":
+		records, skipped, err = parseKML(bytes.NewReader(data))
+	default:
+		sendBadReq(w, fmt.Sprintf("unsupported file format '%s'; only GPX and KML are supported", format))
+		return
+	}
+	if err != nil {
+		sendBadReq(w, fmt.Sprintf("unable to parse the %s file: %v", strings.ToUpper(format), err))
+		return
+	}
+
+	result := locationUploadResult{Received: len(records) + skipped, Rejected: skipped}
+	valid := make([]*LocationRecord, 0, len(records))
+	for _, record := range records {
+		if record.validate() != nil {
+			result.Rejected++
+			continue
+		}
+		record.OwnerID = userID
+		valid = append(valid, record)
+	}
+
+	inserted, duplicates, err := db().AddLocationRecords(valid, LocationConflictSkip)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	result.Accepted = inserted
+	result.Duplicates = duplicates
+
+	sendSuccess(w, result)
+}
+
+// locationExportWriter is implemented by each of the location export formats
+type locationExportWriter interface {
+	writeRecord(rec *LocationRecord) error
+	Close() error
+}
+
+func exportLocationRecords(w http.ResponseWriter, r *http.Request, contentType, ext string, newWriter func(io.Writer, int64) (locationExportWriter, error)) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseTrackQuery(r, userID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="locations.%s"`, ext))
+	exporter, err := newWriter(w, userID)
+	if err != nil {
+		logErr(NewtonErr(err))
+		return
+	}
+
+	err = db().EachLocationRecord(q, exporter.writeRecord)
+	if err != nil {
+		// the response has already started, so all we can do is log it
+		logErr(NewtonErr(err))
+		return
+	}
+
+	if err = exporter.Close(); err != nil {
+		logErr(NewtonErr(err))
+	}
+}
+
+// ExportLocationRecordsGPXHandler handles GET /locations/gpx
+func ExportLocationRecordsGPXHandler(w http.ResponseWriter, r *http.Request) {
+	exportLocationRecords(w, r, "application/gpx+xml", "gpx", func(w io.Writer, userID int64) (locationExportWriter, error) {
+		return newGPXWriter(w, "Newton location history")
+	})
+}
+
+// ExportLocationRecordsGeoJSONHandler handles GET /locations/geojson
+func ExportLocationRecordsGeoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	exportLocationRecords(w, r, "application/geo+json", "geojson", func(w io.Writer, userID int64) (locationExportWriter, error) {
+		return newGeoJSONWriter(w, userID), nil
+	})
+}
+
+// parsePositiveFloat reads an optional, strictly positive query parameter
+func parsePositiveFloat(r *http.Request, name string, defaultVal float64) (float64, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return defaultVal, nil
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) || val <= 0 {
+		return 0, fmt.Errorf("'%s' must be a number greater than 0", name)
+	}
+	return val, nil
+}
+
+// GetSimplifiedLocationRecordsHandler handles GET /locations/simplified
+//
+// The user's track for the time range is reduced with Douglas-Peucker to the
+// points that deviate from the simplified path by more than 'tolerance' meters.
+func GetSimplifiedLocationRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseTrackQuery(r, userID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+	tolerance, err := parsePositiveFloat(r, "tolerance", 10)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	records, err := db().LocationRecords(q)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, simplifyLocationRecords(records, tolerance))
+}
+
+// GetLocationSegmentsHandler handles GET /locations/trips
+//
+// The user's track for the time range is split into stays and trips. A stay is
+// at least 'min_stay' seconds spent within 'stay_radius' meters of one spot.
+func GetLocationSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseTrackQuery(r, userID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+	stayRadius, err := parsePositiveFloat(r, "stay_radius", 100)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+	minStay, err := parsePositiveFloat(r, "min_stay", 300)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	records, err := db().LocationRecords(q)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, segmentLocationRecords(records, stayRadius, int64(minStay*1000)))
 }
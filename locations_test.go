@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+ <metadata><time>2017-01-01T00:00:00Z</time></metadata>
+ <trk>
+  <trkseg>
+   <trkpt lat="32.7767" lon="-96.797"><ele>130</ele><time>2017-01-01T12:00:00Z</time></trkpt>
+   <trkpt lat="32.7768" lon="-96.7971"><time>2017-01-01T12:00:01.5Z</time></trkpt>
+   <trkpt lat="32.7769" lon="-96.7972"></trkpt>
+  </trkseg>
+ </trk>
+</gpx>`
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+ <Document>
+  <Placemark>
+   <gx:Track>
+    <when>2017-01-01T12:00:00Z</when>
+    <when>2017-01-01T12:00:05Z</when>
+    <gx:coord>-122.0 37.0 10</gx:coord>
+    <gx:coord>-122.1 37.1 10</gx:coord>
+   </gx:Track>
+  </Placemark>
+  <Placemark>
+   <TimeStamp><when>2017-01-02T00:00:00Z</when></TimeStamp>
+   <Point><coordinates>10,20,0</coordinates></Point>
+  </Placemark>
+  <Placemark>
+   <LineString><coordinates>1,2 3,4</coordinates></LineString>
+  </Placemark>
+ </Document>
+</kml>`
+
+func TestParseGPX(t *testing.T) {
+	records, skipped, err := parseGPX(strings.NewReader(testGPX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, found %d", len(records))
+	}
+	if skipped != 1 {
+		t.Fatalf("expected 1 skipped point, found %d", skipped)
+	}
+	if records[0].Timestamp != 1483272000000 || records[0].Latitude != 32.7767 || records[0].Longitude != -96.797 {
+		t.Fatalf("unexpected first record: %+v", records[0])
+	}
+	if records[0].Altitude == nil || *records[0].Altitude != 130 {
+		t.Fatal("elevation was not read")
+	}
+	if records[1].Timestamp != 1483272001500 {
+		t.Fatalf("fractional seconds were not preserved: %d", records[1].Timestamp)
+	}
+}
+
+func TestGPXRoundTrip(t *testing.T) {
+	altitude, speed, bearing, source := 130.5, 12.25, 270.0, "gps & wifi"
+	records := []*LocationRecord{
+		{Timestamp: 1483272000000, Latitude: 32.7767, Longitude: -96.797, Altitude: &altitude, Speed: &speed, Bearing: &bearing, Source: &source},
+		{Timestamp: 1483272001500, Latitude: 32.7768, Longitude: -96.7971},
+	}
+
+	buf := &bytes.Buffer{}
+	gw, err := newGPXWriter(buf, "Arlen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err = gw.writeRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, skipped, err := parseGPX(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || skipped != 0 {
+		t.Fatalf("expected 2 records, found %d and %d skipped", len(parsed), skipped)
+	}
+	first := parsed[0]
+	if first.Timestamp != records[0].Timestamp || first.Latitude != records[0].Latitude || first.Longitude != records[0].Longitude {
+		t.Fatalf("unexpected first record %+v", first)
+	}
+	if first.Altitude == nil || *first.Altitude != altitude || first.Speed == nil || *first.Speed != speed ||
+		first.Bearing == nil || *first.Bearing != bearing || first.Source == nil || *first.Source != source {
+		t.Fatalf("the first record's details weren't kept: %+v", first)
+	}
+	if second := parsed[1]; second.Timestamp != records[1].Timestamp || second.Altitude != nil || second.Speed != nil || second.Bearing != nil {
+		t.Fatalf("unexpected second record %+v", second)
+	}
+}
+
+func TestParseKML(t *testing.T) {
+	records, skipped, err := parseKML(strings.NewReader(testKML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, found %d", len(records))
+	}
+	if skipped != 2 {
+		t.Fatalf("expected 2 skipped points, found %d", skipped)
+	}
+	if records[1].Timestamp != 1483272005000 || records[1].Latitude != 37.1 || records[1].Longitude != -122.1 {
+		t.Fatalf("unexpected track record: %+v", records[1])
+	}
+	if records[1].Altitude == nil || *records[1].Altitude != 10 {
+		t.Fatal("track altitude was not read")
+	}
+	if records[2].Latitude != 20 || records[2].Longitude != 10 {
+		t.Fatalf("unexpected placemark record: %+v", records[2])
+	}
+
+	format, err := sniffLocationFormat([]byte(testKML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "kml" {
+		t.Fatalf("expected 'kml', found '%s'", format)
+	}
+}
+
+func TestBoundsAroundPoint(t *testing.T) {
+	bounds := boundsAroundPoint(32.7767, -96.797, 1000)
+	if !bounds.Contains(32.7767, -96.797) {
+		t.Fatal("bounds don't contain their center")
+	}
+	if haversineDistance(32.7767, -96.797, bounds.MaxLatitude, -96.797) < 999 {
+		t.Fatal("bounds are too small")
+	}
+
+	// crossing the antimeridian
+	bounds = boundsAroundPoint(0, 179.999, 1000)
+	if bounds.MinLongitude < bounds.MaxLongitude {
+		t.Fatalf("expected the bounds to wrap around: %+v", bounds)
+	}
+	if !bounds.Contains(0, -179.999) || bounds.Contains(0, 0) {
+		t.Fatalf("wrapped bounds are incorrect: %+v", bounds)
+	}
+}
+
+func TestSimplifyLocationRecords(t *testing.T) {
+	// a straight line north with a single 500m detour east in the middle
+	records := make([]LocationRecord, 0)
+	for i := 0; i <= 10; i++ {
+		rec := LocationRecord{Timestamp: int64(i) * 1000, Latitude: 32 + float64(i)*0.001, Longitude: -96.8}
+		if i == 5 {
+			rec.Longitude += 0.005
+		}
+		records = append(records, rec)
+	}
+
+	simplified := simplifyLocationRecords(records, 10)
+	if len(simplified) != 5 {
+		t.Fatalf("expected 5 records, found %d: %+v", len(simplified), simplified)
+	}
+	if simplified[0].Timestamp != 0 || simplified[2].Timestamp != 5000 || simplified[4].Timestamp != 10000 {
+		t.Fatalf("unexpected records kept: %+v", simplified)
+	}
+
+	simplified = simplifyLocationRecords(records, 1000)
+	if len(simplified) != 2 {
+		t.Fatalf("expected only the end points with a large tolerance, found %d", len(simplified))
+	}
+}
+
+func TestSegmentLocationRecords(t *testing.T) {
+	records := make([]LocationRecord, 0)
+	ts := int64(0)
+	add := func(lat, lon float64) {
+		records = append(records, LocationRecord{Timestamp: ts, Latitude: lat, Longitude: lon})
+		ts += 60 * 1000
+	}
+	// 10 minutes at home, a drive north, then 10 minutes at work
+	for i := 0; i < 10; i++ {
+		add(32.0, -96.8)
+	}
+	for i := 1; i < 10; i++ {
+		add(32.0+float64(i)*0.01, -96.8)
+	}
+	for i := 0; i < 10; i++ {
+		add(32.1, -96.8)
+	}
+
+	segments := segmentLocationRecords(records, 100, 5*60*1000)
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, found %d", len(segments))
+	}
+	if segments[0].Type != LocationSegmentStay || segments[1].Type != LocationSegmentTrip || segments[2].Type != LocationSegmentStay {
+		t.Fatalf("unexpected segment types: %s, %s, %s", segments[0].Type, segments[1].Type, segments[2].Type)
+	}
+	trip := segments[1]
+	if trip.Start != segments[0].End || trip.End != segments[2].Start {
+		t.Fatalf("trip doesn't connect the stays: %+v", trip)
+	}
+	if trip.Distance < 11000 || trip.Distance > 11300 {
+		t.Fatalf("unexpected trip distance: %v", trip.Distance)
+	}
+}
+
+func TestSegmentLocationRecordsAcrossAntimeridian(t *testing.T) {
+	records := make([]LocationRecord, 0)
+	for i := 0; i < 10; i++ {
+		lon := 179.9999
+		if i%2 == 1 {
+			lon = -179.9999
+		}
+		records = append(records, LocationRecord{Timestamp: int64(i) * 60 * 1000, Latitude: -16.8, Longitude: lon})
+	}
+
+	segments := segmentLocationRecords(records, 100, 5*60*1000)
+	if len(segments) != 1 || segments[0].Type != LocationSegmentStay {
+		t.Fatalf("expected a single stay, found %d segments", len(segments))
+	}
+	if lon := segments[0].StartLongitude; math.Abs(lon) < 179.99 {
+		t.Fatalf("the stay's center should be on the antimeridian, found %v", lon)
+	}
+}
+
+func TestParseLocationAreaRejectsNonFinite(t *testing.T) {
+	for _, query := range []string{
+		"lat=NaN&lon=0&radius=10",
+		"lat=0&lon=0&radius=Inf",
+		"min_lat=NaN&min_lon=0&max_lat=1&max_lon=1",
+		"min_lat=0&min_lon=-Inf&max_lat=1&max_lon=1",
+	} {
+		r := httptest.NewRequest("GET", "/locations?"+query, nil)
+		if _, err := parseLocationArea(r); err == nil {
+			t.Errorf("expected %q to be rejected", query)
+		}
+	}
+	for _, value := range []string{"NaN", "Inf", "-Inf", "0"} {
+		r := httptest.NewRequest("GET", "/locations/simplified?tolerance="+value, nil)
+		if _, err := parsePositiveFloat(r, "tolerance", 10); err == nil {
+			t.Errorf("expected a tolerance of %s to be rejected", value)
+		}
+	}
+}
+
+func TestGeoJSONWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	gw := newGeoJSONWriter(buf, 1)
+	records := 2*geoJSONChunkSize + 1
+	for i := 0; i < records; i++ {
+		if err := gw.writeRecord(&LocationRecord{Timestamp: int64(i) * 1000, Latitude: 1, Longitude: float64(i) / 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var collection struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates [][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				CoordTimes []string `json:"coordTimes"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &collection); err != nil {
+		t.Fatal(err)
+	}
+	// every feature after the first starts where the previous one ended
+	if len(collection.Features) != 3 {
+		t.Fatalf("expected 3 features, found %d", len(collection.Features))
+	}
+	positions := 0
+	for _, f := range collection.Features {
+		if len(f.Geometry.Coordinates) != len(f.Properties.CoordTimes) {
+			t.Fatalf("%d coordinates but %d times", len(f.Geometry.Coordinates), len(f.Properties.CoordTimes))
+		}
+		positions += len(f.Geometry.Coordinates)
+	}
+	if positions != records+len(collection.Features)-1 {
+		t.Fatalf("expected %d positions, found %d", records+len(collection.Features)-1, positions)
+	}
+}
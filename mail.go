@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// gMailer delivers all outgoing email. It's configured in loadConfig, and is
+// nil if no mailer is, in which case password resets are turned off.
+var gMailer Mailer
+
+// gMailFrom is the From address of outgoing email
+var gMailFrom = "newton@localhost"
+
+// smtpMailer sends email through an SMTP server
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// newSMTPMailer returns a Mailer that relays through the SMTP server at addr
+// (host:port). If username is empty, no authentication is attempted.
+func newSMTPMailer(addr, username, password, from string) (Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address '%s' - %v", addr, err)
+	}
+
+	m := &smtpMailer{addr: addr, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg := formatMail(m.from, to, subject, body, time.Now())
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg)
+}
+
+// fileMailer writes each email to a file in a directory instead of sending
+// it. It's meant for local development and testing.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m fileMailer) Send(to, subject, body string) error {
+	now := time.Now()
+	name := fmt.Sprintf("%d-%s.eml", now.UnixNano(), randAlphaNum(6))
+	return ioutil.WriteFile(filepath.Join(m.dir, name), formatMail(m.from, to, subject, body, now), 0600)
+}
+
+// formatMail builds an RFC 5322 message
+func formatMail(from, to, subject, body string, date time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return buf.Bytes()
+}
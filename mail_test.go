@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "newton-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := fileMailer{dir: dir, from: "newton@example.com"}
+	if err = m.Send("hank@example.com", "Propane", "line one\nline two"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 email, found %d", len(files))
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(data)
+	for _, want := range []string{"From: newton@example.com\r\n", "To: hank@example.com\r\n", "Subject: Propane\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("email is missing %q:\n%s", want, msg)
+		}
+	}
+}
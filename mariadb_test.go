@@ -2,9 +2,19 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 var bookmarkObject *Bookmark
@@ -18,15 +28,25 @@ const testPassword = "a bad password"
 
 var imageData = []byte{137, 80, 78, 71, 13, 10, 26, 10, 0, 0, 0, 13, 73, 72, 68, 82, 0, 0, 0, 27, 0, 0, 0, 27, 8, 4, 0, 0, 0, 39, 221, 60, 222, 0, 0, 0, 252, 73, 68, 65, 84, 120, 1, 237, 212, 161, 75, 107, 97, 28, 6, 224, 7, 150, 212, 102, 211, 164, 77, 133, 25, 214, 108, 155, 81, 48, 234, 13, 23, 46, 227, 150, 11, 6, 17, 220, 255, 225, 48, 136, 97, 147, 253, 21, 154, 134, 75, 22, 5, 141, 75, 227, 196, 45, 202, 101, 90, 6, 159, 240, 133, 3, 115, 158, 125, 101, 193, 224, 243, 134, 23, 62, 126, 239, 137, 199, 39, 171, 134, 246, 76, 171, 25, 90, 146, 112, 234, 213, 111, 151, 158, 12, 60, 186, 240, 199, 127, 127, 37, 149, 60, 8, 83, 233, 41, 73, 234, 8, 51, 185, 145, 240, 43, 158, 53, 101, 226, 64, 166, 25, 251, 200, 92, 47, 241, 168, 161, 47, 206, 244, 53, 98, 63, 155, 99, 93, 40, 204, 154, 66, 21, 89, 97, 42, 22, 165, 102, 100, 96, 71, 85, 40, 76, 85, 89, 102, 164, 42, 119, 39, 8, 174, 18, 179, 235, 216, 183, 114, 189, 248, 208, 73, 204, 58, 177, 123, 139, 159, 253, 204, 186, 241, 161, 157, 152, 181, 99, 119, 229, 78, 4, 19, 7, 137, 217, 161, 137, 224, 159, 28, 219, 54, 176, 59, 103, 86, 198, 166, 45, 95, 218, 87, 23, 98, 90, 234, 90, 66, 76, 93, 77, 74, 126, 42, 255, 4, 190, 219, 236, 61, 158, 30, 231, 63, 164, 55, 105, 56, 55, 214, 181, 140, 21, 247, 198, 206, 204, 248, 0, 255, 61, 90, 202, 148, 177, 201, 123, 0, 0, 0, 0, 73, 69, 78, 68, 174, 66, 96, 130}
 
-func TestInstantiateDatabase(t *testing.T) {
-	dsn := os.Getenv("SQLITE_DB")
-	if dsn == "" {
-		log.Fatal("You need to specify the SQL_DB environment variable to instantiate the database.")
-	}
+var instantiateDatabaseOnce sync.Once
 
-	if err := InitDB(dsn); err != nil {
-		log.Fatal(err)
-	}
+// instantiateDatabase opens the test database, so that tests in other files
+// can use it without depending on running after TestInstantiateDatabase
+func instantiateDatabase() {
+	instantiateDatabaseOnce.Do(func() {
+		dsn := os.Getenv("SQLITE_DB")
+		if dsn == "" {
+			log.Fatal("You need to specify the SQL_DB environment variable to instantiate the database.")
+		}
+
+		if err := InitDB(dsn); err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+func TestInstantiateDatabase(t *testing.T) {
+	instantiateDatabase()
 }
 
 func TestCreateUser(t *testing.T) {
@@ -101,6 +121,10 @@ func TestEditUser(t *testing.T) {
 		t.Fatal("unable to retrieve user")
 	}
 
+	password := *user.Password
+	updatedFullName := "Hank Hill"
+	user.FullName = &updatedFullName
+	// the password is only changed through SetUserPassword
 	updatedPassword := "something"
 	user.Password = &updatedPassword
 	err = db().EditUser(user)
@@ -112,8 +136,39 @@ func TestEditUser(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if *updatedUser.Password != updatedPassword {
-		t.Fatalf("edit user failed: %s != %s", *updatedUser.Password, updatedPassword)
+	if *updatedUser.FullName != updatedFullName {
+		t.Fatalf("edit user failed: %s != %s", *updatedUser.FullName, updatedFullName)
+	}
+	if *updatedUser.Password != password {
+		t.Fatal("editing the user changed their password")
+	}
+}
+
+func TestEditUserOnlyChangesOneUser(t *testing.T) {
+	otherID, err := db().CreateUser(NewUser(testUsername+"-other", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db().User(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullName := "Somebody Else"
+	user.FullName = &fullName
+	if err = db().EditUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := db().User(otherID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *other.FullName != testFullName {
+		t.Fatal("editing one user changed another")
+	}
+	if other.IsAdmin() {
+		t.Fatal("new users shouldn't be admins")
 	}
 }
 
@@ -190,6 +245,21 @@ func TestEditBookmark(t *testing.T) {
 	if *retrieved.Title != *bookmarkObject.Title {
 		t.Fatal("Bookmark.Title did not match after editing")
 	}
+	// a null title clears it rather than failing
+	bookmarkObject.Title = nil
+	if err = db().EditBookmark(bookmarkObject); err != nil {
+		t.Fatal(err)
+	}
+	if retrieved, err = db().Bookmark(*bookmarkObject.ID, newUserID); err != nil {
+		t.Fatal(err)
+	}
+	if *retrieved.Title != "" {
+		t.Fatalf("expected the title to be cleared, found %q", *retrieved.Title)
+	}
+	bookmarkObject.Title = &title
+	if err = db().EditBookmark(bookmarkObject); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteBookmark(t *testing.T) {
@@ -208,7 +278,7 @@ func TestDeleteBookmark(t *testing.T) {
 }
 
 func TestRetrieveBookmarks(t *testing.T) {
-	bookmarks, err := db().Bookmarks(newUserID, 0, 0)
+	bookmarks, err := db().Bookmarks(NewBookmarkQuery(newUserID))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -232,8 +302,16 @@ func TestCreateSession(t *testing.T) {
 	}
 }
 
-func TestSessionByAccessToken(t *testing.T) {
-	session, err := db().SessionByAccessToken(newAccessToken)
+func TestSessionByAccessTokenHash(t *testing.T) {
+	session, err := db().SessionByAccessTokenHash(newAccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session != nil {
+		t.Fatal("a session was found using the plaintext access token")
+	}
+
+	session, err = db().SessionByAccessTokenHash(hashToken(newAccessToken))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -242,11 +320,14 @@ func TestSessionByAccessToken(t *testing.T) {
 		t.Fatal("missing session object")
 	}
 
-	if session.AccessToken == nil {
-		t.Fatal("access token was nil")
+	if session.AccessToken != nil {
+		t.Fatal("the plaintext access token should never be retrieved")
+	}
+	if session.AccessTokenHash == nil {
+		t.Fatal("access token hash was nil")
 	}
-	if *session.AccessToken != newAccessToken {
-		t.Fatalf("access token did not match: %s != %s", *session.AccessToken, newAccessToken)
+	if *session.AccessTokenHash != hashToken(newAccessToken) {
+		t.Fatalf("access token hash did not match: %s != %s", *session.AccessTokenHash, hashToken(newAccessToken))
 	}
 
 	if session.UserID == nil {
@@ -257,6 +338,125 @@ func TestSessionByAccessToken(t *testing.T) {
 	}
 }
 
+func TestSessionsByUserID(t *testing.T) {
+	other := NewSession(newUserID)
+	device := "Pixel"
+	other.Device = &device
+	otherID, err := db().CreateSession(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed := time.Now().Add(time.Hour)
+	if err = db().TouchSession(otherID, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := db().SessionsByUserID(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, found %d", len(sessions))
+	}
+	if *sessions[0].ID != otherID {
+		t.Fatal("sessions weren't ordered by last use")
+	}
+	if sessions[0].Device == nil || *sessions[0].Device != device {
+		t.Fatal("device wasn't stored")
+	}
+	if sessions[0].LastUsedDate == nil || !sessions[0].LastUsedDate.Equal(lastUsed) {
+		t.Fatalf("last used date wasn't updated: %v", sessions[0].LastUsedDate)
+	}
+
+	if err = db().DeleteSession(otherID, newUserID+1); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := db().Session(otherID, newUserID); session == nil {
+		t.Fatal("a session was deleted by the wrong user")
+	}
+	if err = db().DeleteSession(otherID, newUserID); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := db().Session(otherID, newUserID); session != nil {
+		t.Fatal("the session wasn't deleted")
+	}
+}
+
+func TestRotateSessionTokens(t *testing.T) {
+	session := NewSession(newUserID)
+	sessionID, err := db().CreateSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.ID = &sessionID
+
+	oldRefreshHash := *session.RefreshTokenHash
+	found, err := db().SessionByRefreshTokenHash(oldRefreshHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || *found.ID != sessionID {
+		t.Fatal("session wasn't found by its refresh token")
+	}
+	if found.AccessTokenExpirationDate == nil {
+		t.Fatal("access token expiration date wasn't stored")
+	}
+
+	session.issueTokens(time.Now())
+	rotated, err := db().RotateSessionTokens(session, oldRefreshHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("tokens weren't rotated")
+	}
+
+	// the old refresh token can't be exchanged a second time
+	rotated, err = db().RotateSessionTokens(session, oldRefreshHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated {
+		t.Fatal("a retired refresh token was accepted")
+	}
+	if found, _ = db().SessionByRefreshTokenHash(oldRefreshHash); found != nil {
+		t.Fatal("session was found by a retired refresh token")
+	}
+
+	retiredID, userID, err := db().SessionByRetiredRefreshTokenHash(oldRefreshHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retiredID != sessionID || userID != newUserID {
+		t.Fatalf("retired refresh token wasn't tracked: %d, %d", retiredID, userID)
+	}
+
+	if err = db().DeleteSession(sessionID, newUserID); err != nil {
+		t.Fatal(err)
+	}
+	if retiredID, _, _ = db().SessionByRetiredRefreshTokenHash(oldRefreshHash); retiredID != 0 {
+		t.Fatal("retired refresh tokens weren't deleted with the session")
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	session := NewSession(newUserID)
+	now := time.Now()
+	if session.Expired(now) {
+		t.Fatal("a new session shouldn't be expired")
+	}
+	if !session.Expired(now.Add(gSessionIdleTimeout + time.Minute)) {
+		t.Fatal("an idle session should be expired")
+	}
+
+	recent := now.Add(gSessionMaxAge)
+	session.LastUsedDate = &recent
+	if !session.Expired(now.Add(gSessionMaxAge + time.Minute)) {
+		t.Fatal("an old session should be expired even if it was recently used")
+	}
+}
+
 func TestCreateContact(t *testing.T) {
 	givenName := "Hank"
 	familyName := "Hill"
@@ -439,5 +639,1011 @@ func TestSetContactPhoto(t *testing.T) {
 }
 
 func TestCreateLocationRecord(t *testing.T) {
+	for i := int64(1); i <= 5; i++ {
+		record := &LocationRecord{
+			Timestamp: 1000 * i,
+			Latitude:  32.7767 + float64(i)/1000,
+			Longitude: -96.7970,
+			OwnerID:   newUserID,
+		}
+		if err := db().AddLocationRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the same timestamp can't be recorded twice for one user
+	err := db().AddLocationRecord(&LocationRecord{Timestamp: 1000, OwnerID: newUserID})
+	if err == nil {
+		t.Fatal("expected an error when adding a duplicate location record")
+	}
+}
+
+func TestAddLocationRecords(t *testing.T) {
+	records := []*LocationRecord{
+		{Timestamp: 5000, Latitude: 1, Longitude: 1, OwnerID: newUserID}, // duplicate
+		{Timestamp: 6000, Latitude: 32.783, Longitude: -96.797, OwnerID: newUserID},
+	}
+	inserted, duplicates, err := db().AddLocationRecords(records, LocationConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 1 || duplicates != 1 {
+		t.Fatalf("expected 1 inserted and 1 duplicate record, found %d and %d", inserted, duplicates)
+	}
+
+	// resending the same batch should be harmless
+	inserted, duplicates, err = db().AddLocationRecords(records, LocationConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 0 || duplicates != 2 {
+		t.Fatalf("expected 0 inserted and 2 duplicate records on resend, found %d and %d", inserted, duplicates)
+	}
+
+	records = records[1:]
+	records[0].Latitude = 40
+	inserted, duplicates, err = db().AddLocationRecords(records, LocationConflictReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 0 || duplicates != 1 {
+		t.Fatalf("expected 1 replaced record, found %d inserted and %d duplicates", inserted, duplicates)
+	}
+	q := NewLocationQuery(newUserID)
+	q.Since = 5999
+	found, err := db().LocationRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Latitude != 40 {
+		t.Fatalf("record was not replaced: %+v", found)
+	}
+}
+
+func TestLocationRecords(t *testing.T) {
+	q := NewLocationQuery(newUserID)
+	q.Ascending = true
+	records, err := db().LocationRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 location records, found %d", len(records))
+	}
+	if records[0].Timestamp != 1000 || records[0].OwnerID != newUserID {
+		t.Fatalf("unexpected first record: %+v", records[0])
+	}
+
+	q = NewLocationQuery(newUserID)
+	q.Since = 1000
+	q.Until = 5000
+	q.Limit = 2
+	records, err = db().LocationRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 location records, found %d", len(records))
+	}
+	if records[0].Timestamp != 4000 || records[1].Timestamp != 3000 {
+		t.Fatalf("records were not in descending order: %+v", records)
+	}
+}
+
+func TestEachLocationRecord(t *testing.T) {
+	q := NewLocationQuery(newUserID)
+	q.Since = 2000
+	q.Ascending = true
+	var timestamps []int64
+	err := db().EachLocationRecord(q, func(rec *LocationRecord) error {
+		timestamps = append(timestamps, rec.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 4 || timestamps[0] != 3000 || timestamps[3] != 6000 {
+		t.Fatalf("unexpected timestamps: %v", timestamps)
+	}
+}
+
+func TestEachLocationRecordInBounds(t *testing.T) {
+	q := NewLocationQuery(newUserID)
+	q.Ascending = true
+	q.Bounds = &LocationBounds{MinLatitude: 32.778, MinLongitude: -97, MaxLatitude: 32.781, MaxLongitude: -96}
+	var timestamps []int64
+	err := db().EachLocationRecord(q, func(rec *LocationRecord) error {
+		timestamps = append(timestamps, rec.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 3 || timestamps[0] != 2000 || timestamps[2] != 4000 {
+		t.Fatalf("unexpected timestamps: %v", timestamps)
+	}
+
+	// a box that crosses the antimeridian shouldn't match anything in Dallas
+	q.Bounds = &LocationBounds{MinLatitude: -90, MinLongitude: 170, MaxLatitude: 90, MaxLongitude: -170}
+	err = db().EachLocationRecord(q, func(rec *LocationRecord) error {
+		t.Fatalf("unexpected record: %+v", rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocationRecordDetails(t *testing.T) {
+	accurate := 5.0
+	inaccurate := 500.0
+	altitude := 130.5
+	source := "gps"
+	records := []*LocationRecord{
+		{Timestamp: 7000, Latitude: 32.78, Longitude: -96.8, Accuracy: &accurate, Altitude: &altitude, Source: &source, OwnerID: newUserID},
+		{Timestamp: 8000, Latitude: 32.78, Longitude: -96.8, Accuracy: &inaccurate, OwnerID: newUserID},
+	}
+	if _, _, err := db().AddLocationRecords(records, LocationConflictSkip); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewLocationQuery(newUserID)
+	q.Since = 6000
+	q.Ascending = true
+	found, err := db().LocationRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 records, found %d", len(found))
+	}
+	if found[0].Accuracy == nil || *found[0].Accuracy != accurate ||
+		found[0].Altitude == nil || *found[0].Altitude != altitude ||
+		found[0].Source == nil || *found[0].Source != source ||
+		found[0].Speed != nil || found[0].Bearing != nil {
+		t.Fatalf("details were not stored correctly: %+v", found[0])
+	}
+
+	// records without an accuracy are kept, but the inaccurate one isn't
+	q = NewLocationQuery(newUserID)
+	q.MaxAccuracy = 50
+	found, err = db().LocationRecords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range found {
+		if rec.Timestamp == 8000 {
+			t.Fatal("the inaccurate record should have been filtered out")
+		}
+	}
+	if len(found) != 7 {
+		t.Fatalf("expected 7 records, found %d", len(found))
+	}
+}
+
+func TestUserTOTP(t *testing.T) {
+	totp := &UserTOTP{UserID: newUserID, Secret: newTOTPSecret(), CreationDate: time.Now()}
+	if err := db().SetUserTOTP(totp); err != nil {
+		t.Fatal(err)
+	}
+	found, err := db().UserTOTP(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Secret != totp.Secret || found.Confirmed {
+		t.Fatalf("unexpected totp enrollment %+v", found)
+	}
+
+	// codes can't be used until the enrollment is confirmed
+	if used, _ := db().UseTOTPCounter(newUserID, 100); used {
+		t.Fatal("an unconfirmed secret was used")
+	}
 
+	_, hashes := newRecoveryCodes()
+	if err = db().ConfirmUserTOTP(newUserID, 100, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := db().UseTOTPCounter(newUserID, 100); used {
+		t.Fatal("the code used to confirm was replayed")
+	}
+	if used, _ := db().UseTOTPCounter(newUserID, 101); !used {
+		t.Fatal("a new code wasn't accepted")
+	}
+
+	if used, _ := db().UseRecoveryCode(newUserID, hashes[0]); !used {
+		t.Fatal("a recovery code wasn't accepted")
+	}
+	if used, _ := db().UseRecoveryCode(newUserID, hashes[0]); used {
+		t.Fatal("a recovery code was used twice")
+	}
+	if used, _ := db().UseRecoveryCode(newUserID+1, hashes[1]); used {
+		t.Fatal("another user's recovery code was accepted")
+	}
+
+	if err = db().DeleteUserTOTP(newUserID); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = db().UserTOTP(newUserID); found != nil {
+		t.Fatal("totp enrollment wasn't deleted")
+	}
+	if used, _ := db().UseRecoveryCode(newUserID, hashes[1]); used {
+		t.Fatal("recovery codes weren't deleted")
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	defer func(username, ip *loginThrottle) { gUsernameThrottle, gIPThrottle = username, ip }(gUsernameThrottle, gIPThrottle)
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := db().CreateUser(NewUser("cotton", testFullName, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(userID)
+	if _, err = db().CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().SetUserTOTP(&UserTOTP{UserID: userID, Secret: newTOTPSecret(), CreationDate: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes := newRecoveryCodes()
+	if err = db().ConfirmUserTOTP(userID, 0, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	installEndpoints(router)
+	disable := func(body string) int {
+		r := httptest.NewRequest("DELETE", fmt.Sprintf("/users/%d/totp", userID), strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+*session.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the password alone isn't enough
+	if code := disable(fmt.Sprintf(`{"password": %q}`, testPassword)); code != http.StatusBadRequest {
+		t.Fatalf("expected a missing code to be rejected, found %d", code)
+	}
+
+	// wrong passwords are throttled once the free attempts are used up
+	gUsernameThrottle = newLoginThrottle(2, 10, time.Minute, time.Hour)
+	gIPThrottle = newLoginThrottle(100, 1000, time.Minute, time.Hour)
+	for i := 0; i < 3; i++ {
+		if code := disable(fmt.Sprintf(`{"password": "wrong", "recovery_code": %q}`, codes[0])); code != http.StatusUnauthorized {
+			t.Fatalf("expected a wrong password to be unauthorized, found %d", code)
+		}
+	}
+	if code := disable(fmt.Sprintf(`{"password": %q, "recovery_code": %q}`, testPassword, codes[0])); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the attempt to be throttled, found %d", code)
+	}
+	if found, _ := db().UserTOTP(userID); found == nil {
+		t.Fatal("totp was disabled by a throttled attempt")
+	}
+
+	gUsernameThrottle = newLoginThrottle(2, 10, time.Minute, time.Hour)
+	if code := disable(fmt.Sprintf(`{"password": %q, "recovery_code": %q}`, testPassword, codes[0])); code != http.StatusOK {
+		t.Fatalf("expected totp to be disabled, found %d", code)
+	}
+	if found, _ := db().UserTOTP(userID); found != nil {
+		t.Fatal("totp wasn't disabled")
+	}
+}
+
+func TestSetUserPassword(t *testing.T) {
+	if err := db().SetUserPassword(newUserID, "a new hash"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db().User(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *user.Password != "a new hash" {
+		t.Fatalf("password wasn't updated: %s", *user.Password)
+	}
+}
+
+func TestDeleteOtherSessions(t *testing.T) {
+	keep := NewSession(newUserID)
+	keepID, err := db().CreateSession(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db().CreateSession(NewSession(newUserID)); err != nil {
+		t.Fatal(err)
+	}
+	otherUsers, err := db().CreateSession(NewSession(newUserID + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db().DeleteOtherSessions(newUserID, keepID); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := db().SessionsByUserID(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || *sessions[0].ID != keepID {
+		t.Fatalf("expected only session %d to be left, found %d sessions", keepID, len(sessions))
+	}
+	if session, _ := db().Session(otherUsers, newUserID+1); session == nil {
+		t.Fatal("another user's session was deleted")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	user, err := db().User(newUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := "hank@strickland.example"
+	user.Email = &email
+	if err = db().EditUser(user); err != nil {
+		t.Fatal(err)
+	}
+	// email addresses aren't unique, so every account with one is found
+	luanne := NewUser("luanne", testFullName, testPassword)
+	luanneEmail := "HANK@strickland.example"
+	luanne.Email = &luanneEmail
+	luanneID, err := db().CreateUser(luanne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := db().UsersByEmail("Hank@Strickland.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || *found[0].ID != newUserID || *found[1].ID != luanneID {
+		t.Fatalf("expected both users to be found by email, found %d", len(found))
+	}
+
+	now := time.Now()
+	expired := &PasswordReset{UserID: newUserID, TokenHash: hashToken("expired"), CreationDate: now.Add(-2 * time.Hour), ExpirationDate: now.Add(-time.Hour)}
+	valid := &PasswordReset{UserID: newUserID, TokenHash: hashToken("valid"), CreationDate: now, ExpirationDate: now.Add(time.Hour)}
+	other := &PasswordReset{UserID: newUserID, TokenHash: hashToken("other"), CreationDate: now, ExpirationDate: now.Add(time.Hour)}
+	for _, reset := range []*PasswordReset{expired, valid, other} {
+		if err = db().CreatePasswordReset(reset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if userID, _ := db().PasswordResetUserID(expired.TokenHash, now); userID != 0 {
+		t.Fatal("an expired token was accepted")
+	}
+	if userID, _ := db().PasswordResetUserID(valid.TokenHash, now); userID != newUserID {
+		t.Fatalf("expected user %d, found %d", newUserID, userID)
+	}
+
+	if _, err = db().CreateSession(NewSession(newUserID)); err != nil {
+		t.Fatal(err)
+	}
+	reset, err := db().ResetPassword(valid.TokenHash, "reset hash", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reset {
+		t.Fatal("the password wasn't reset")
+	}
+	if user, _ = db().User(newUserID); *user.Password != "reset hash" {
+		t.Fatal("the password wasn't updated")
+	}
+	if sessions, _ := db().SessionsByUserID(newUserID); len(sessions) != 0 {
+		t.Fatal("sessions weren't revoked")
+	}
+
+	// every outstanding token is used up
+	if reset, _ = db().ResetPassword(valid.TokenHash, "again", now); reset {
+		t.Fatal("a token was used twice")
+	}
+	if reset, _ = db().ResetPassword(other.TokenHash, "again", now); reset {
+		t.Fatal("another outstanding token was still usable")
+	}
+}
+
+func TestUniqueUsernames(t *testing.T) {
+	if _, err := db().CreateUser(NewUser("ARASH", testFullName, testPassword)); err != errUsernameTaken {
+		t.Fatalf("expected errUsernameTaken, found %v", err)
+	}
+
+	user, err := db().UserByUsername("Arash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user == nil || *user.ID != newUserID {
+		t.Fatal("username lookup should ignore case")
+	}
+
+	otherID, err := db().CreateUser(NewUser("Dale", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db().User(otherID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := "arasH"
+	other.Username = &taken
+	if err = db().EditUser(other); err != errUsernameTaken {
+		t.Fatalf("expected errUsernameTaken, found %v", err)
+	}
+}
+
+func TestMigrateDuplicateUsernames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "newton-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ndb, err := NewSQLiteDB(filepath.Join(dir, "newton.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdb := ndb.(*SQLiteNewtonDB)
+	defer sdb.db.Close()
+
+	// put the database back the way it was before usernames were unique
+	for _, stmt := range []string{
+		"DROP INDEX users_username_normalized",
+		"ALTER TABLE users DROP COLUMN username_normalized",
+		"UPDATE database_version SET version=10",
+		"INSERT INTO users (username, full_name, password) VALUES ('Boomhauer', '', ''), ('boomhauer', '', ''), ('Bill', '', '')",
+	} {
+		if _, err = sdb.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = migrateSQLiteDBFrom10To11(sdb); err != nil {
+		t.Fatal(err)
+	}
+
+	var usernames []string
+	if err = sdb.db.Select(&usernames, "SELECT username FROM users ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Boomhauer", "boomhauer-2", "Bill"}
+	if len(usernames) != len(expected) {
+		t.Fatalf("expected %v, found %v", expected, usernames)
+	}
+	for i := range expected {
+		if usernames[i] != expected[i] {
+			t.Fatalf("expected %v, found %v", expected, usernames)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	userID, err := db().CreateUser(NewUser("bobby", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := NewBookmark("http://example.com", "Example", userID)
+	tagged.Tags = []string{"example"}
+	bookmarkID, err := db().CreateBookmark(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db().SetBookmarkMetadata(bookmarkID, &PageMetadata{Text: "Example"}); err != nil {
+		t.Fatal(err)
+	}
+	folderTitle := "Folder"
+	if _, err = db().CreateBookmarkFolder(&BookmarkFolder{Title: &folderTitle, OwnerID: &userID}); err != nil {
+		t.Fatal(err)
+	}
+	nickname := "Luanne"
+	contactID, err := db().CreateContact(&Contact{
+		OwnerID:  &userID,
+		Nickname: &nickname,
+		Name:     &StructuredName{GivenName: &nickname},
+		Emails:   []*Email{{Address: "luanne@example.com", Type: EmailTypeHome}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db().SetContactPhoto(contactID, imageData); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().AddLocationRecord(&LocationRecord{Timestamp: 1000, Latitude: 1, Longitude: 2, OwnerID: userID}); err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(userID)
+	sessionID, err := db().CreateSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.ID = &sessionID
+	oldRefreshHash := *session.RefreshTokenHash
+	session.issueTokens(time.Now())
+	if _, err = db().RotateSessionTokens(session, oldRefreshHash); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().SetUserTOTP(&UserTOTP{UserID: userID, Secret: newTOTPSecret(), CreationDate: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	_, hashes := newRecoveryCodes()
+	if err = db().ConfirmUserTOTP(userID, 1, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().CreatePasswordReset(&PasswordReset{UserID: userID, TokenHash: hashToken("bobby"), CreationDate: time.Now(), ExpirationDate: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db().DeleteUser(userID); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb := db().(*SQLiteNewtonDB)
+	counts := map[string]string{
+		"users":                  "SELECT COUNT(*) FROM users WHERE id=?",
+		"bookmarks":              "SELECT COUNT(*) FROM bookmarks WHERE owner_id=?",
+		"bookmark_folders":       "SELECT COUNT(*) FROM bookmark_folders WHERE owner_id=?",
+		"tags":                   "SELECT COUNT(*) FROM tags WHERE owner_id=?",
+		"bookmark_snapshots":     "SELECT COUNT(*) FROM bookmark_snapshots WHERE bookmark_id=?",
+		"contacts":               "SELECT COUNT(*) FROM contacts WHERE owner_id=?",
+		"contacts_name":          "SELECT COUNT(*) FROM contacts_name WHERE contact_id=?",
+		"contacts_emails":        "SELECT COUNT(*) FROM contacts_emails WHERE contact_id=?",
+		"contacts_photo":         "SELECT COUNT(*) FROM contacts_photo WHERE contact_id=?",
+		"location_records":       "SELECT COUNT(*) FROM location_records WHERE owner_id=?",
+		"sessions":               "SELECT COUNT(*) FROM sessions WHERE user_id=?",
+		"retired_refresh_tokens": "SELECT COUNT(*) FROM retired_refresh_tokens WHERE session_id=?",
+		"user_totp":              "SELECT COUNT(*) FROM user_totp WHERE user_id=?",
+		"recovery_codes":         "SELECT COUNT(*) FROM recovery_codes WHERE user_id=?",
+		"password_resets":        "SELECT COUNT(*) FROM password_resets WHERE user_id=?",
+	}
+	for table, query := range counts {
+		id := userID
+		switch table {
+		case "contacts_name", "contacts_emails", "contacts_photo":
+			id = contactID
+		case "retired_refresh_tokens":
+			id = sessionID
+		case "bookmark_snapshots":
+			id = bookmarkID
+		}
+		var count int
+		if err = sdb.db.QueryRow(query, id).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows were left in %s", count, table)
+		}
+	}
+
+	if exists, _ := db().UserExists(newUserID); !exists {
+		t.Fatal("another user was deleted")
+	}
+	if contacts, _ := db().Contacts(newUserID); len(contacts) == 0 {
+		t.Fatal("another user's contacts were deleted")
+	}
+}
+
+func TestBookmarkFolders(t *testing.T) {
+	ownerID, err := db().CreateUser(NewUser("kahn", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFolder := func(title string, parentID *int64) int64 {
+		id, err := db().CreateBookmarkFolder(&BookmarkFolder{Title: &title, ParentID: parentID, OwnerID: &ownerID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	newBookmark := func(url string, folderID *int64) int64 {
+		b := NewBookmark(url, url, ownerID)
+		b.FolderID = folderID
+		id, err := db().CreateBookmark(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	bar := newFolder("Bookmarks Bar", nil)
+	news := newFolder("News", &bar)
+	first := newBookmark("http://one.example", &bar)
+	newBookmark("http://two.example", &news)
+	top := newBookmark("http://top.example", nil)
+
+	// other users can't put things in the folder
+	otherBookmark := NewBookmark("http://other.example", "", newUserID)
+	otherBookmark.FolderID = &bar
+	if _, err = db().CreateBookmark(otherBookmark); err != errFolderNotFound {
+		t.Fatalf("expected errFolderNotFound, found %v", err)
+	}
+
+	// move the bookmark in front of the News folder
+	if err = db().MoveBookmark(first, ownerID, &bar, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().MoveBookmark(top, ownerID, &news, -1); err != nil {
+		t.Fatal(err)
+	}
+	folders, err := db().BookmarkFolders(ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bookmarks, err := db().Bookmarks(NewBookmarkQuery(ownerID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := buildBookmarkTree(folders, bookmarks)
+	if len(tree.Folders) != 1 || len(tree.Bookmarks) != 0 {
+		t.Fatalf("expected just the bar at the top level, found %d folders and %d bookmarks", len(tree.Folders), len(tree.Bookmarks))
+	}
+	barNode := tree.Folders[0]
+	if len(barNode.Bookmarks) != 1 || *barNode.Bookmarks[0].ID != first || *barNode.Bookmarks[0].Position != 0 {
+		t.Fatal("the bookmark wasn't moved to the front of the bar")
+	}
+	if len(barNode.Folders) != 1 || *barNode.Folders[0].Position != 1 {
+		t.Fatal("the News folder wasn't moved along to make room")
+	}
+	newsNode := barNode.Folders[0]
+	if len(newsNode.Bookmarks) != 2 || *newsNode.Bookmarks[1].ID != top {
+		t.Fatal("the bookmark wasn't moved to the end of News")
+	}
+
+	// a folder can't be moved into its own subfolder
+	if err = db().MoveBookmarkFolder(bar, ownerID, &news, 0); err != errFolderCycle {
+		t.Fatalf("expected errFolderCycle, found %v", err)
+	}
+	if err = db().MoveBookmarkFolder(news, ownerID, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	folder, err := db().BookmarkFolder(news, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.ParentID != nil || *folder.Position != 0 {
+		t.Fatal("the folder wasn't moved to the top level")
+	}
+
+	// deleting a folder deletes everything in it
+	if err = db().MoveBookmarkFolder(news, ownerID, &bar, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().DeleteBookmarkFolder(bar, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if folders, _ = db().BookmarkFolders(ownerID); len(folders) != 0 {
+		t.Fatalf("expected every folder to be deleted, found %d", len(folders))
+	}
+	if bookmarks, _ = db().Bookmarks(NewBookmarkQuery(ownerID)); len(bookmarks) != 0 {
+		t.Fatalf("expected every bookmark to be deleted, found %d", len(bookmarks))
+	}
+	if err = db().DeleteBookmarkFolder(bar, ownerID); err != errFolderNotFound {
+		t.Fatalf("expected errFolderNotFound, found %v", err)
+	}
+}
+
+func TestBookmarkTags(t *testing.T) {
+	ownerID, err := db().CreateUser(NewUser("peggy", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBookmark := func(url string, tags ...string) int64 {
+		b := NewBookmark(url, "", ownerID)
+		b.Tags = tags
+		id, err := db().CreateBookmark(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	propane := newBookmark("http://propane.example", "Propane", "work")
+	boggle := newBookmark("http://boggle.example", "propane", "games")
+	newBookmark("http://strickland.example", "work")
+
+	bookmark, err := db().Bookmark(propane, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmark.Tags) != 2 || bookmark.Tags[0] != "Propane" || bookmark.Tags[1] != "work" {
+		t.Fatalf("unexpected tags %v", bookmark.Tags)
+	}
+
+	q := NewBookmarkQuery(ownerID)
+	q.Tags = []string{"PROPANE", "work"}
+	q.MatchAllTags = true
+	bookmarks, err := db().Bookmarks(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 1 || *bookmarks[0].ID != propane {
+		t.Fatalf("expected only the bookmark with both tags, found %d", len(bookmarks))
+	}
+	q.MatchAllTags = false
+	if bookmarks, err = db().Bookmarks(q); err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 3 {
+		t.Fatalf("expected every bookmark with either tag, found %d", len(bookmarks))
+	}
+
+	tags, err := db().Tags(ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	ids := make(map[string]int64)
+	for _, tag := range tags {
+		counts[*tag.Name] = *tag.Count
+		ids[*tag.Name] = *tag.ID
+	}
+	if len(tags) != 3 || counts["Propane"] != 2 || counts["work"] != 2 || counts["games"] != 1 {
+		t.Fatalf("unexpected tag counts %v", counts)
+	}
+
+	// other users can't touch the tags
+	if _, err = db().MergeTags(newUserID, []int64{ids["work"]}, "Work"); err != errTagNotFound {
+		t.Fatalf("expected errTagNotFound, found %v", err)
+	}
+
+	// renaming only changes the display name
+	tag, err := db().MergeTags(ownerID, []int64{ids["work"]}, "Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *tag.ID != ids["work"] || *tag.Name != "Work" || *tag.Count != 2 {
+		t.Fatalf("unexpected renamed tag %+v", tag)
+	}
+
+	// renaming onto an existing tag merges them
+	tag, err = db().MergeTags(ownerID, []int64{ids["games"]}, "propane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *tag.ID != ids["Propane"] || *tag.Name != "propane" || *tag.Count != 2 {
+		t.Fatalf("unexpected merged tag %+v", tag)
+	}
+	if tags, _ = db().Tags(ownerID); len(tags) != 2 {
+		t.Fatalf("expected 2 tags after merging, found %d", len(tags))
+	}
+
+	// tags that are no longer used are removed
+	bookmark.Tags = nil
+	if err = db().EditBookmark(bookmark); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().DeleteBookmark(boggle, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ = db().Tags(ownerID); len(tags) != 1 || *tags[0].Name != "Work" {
+		t.Fatalf("expected only the Work tag to remain, found %d tags", len(tags))
+	}
+}
+
+func TestImportBookmarks(t *testing.T) {
+	ownerID, err := db().CreateUser(NewUser("minh", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := db().CreateBookmark(NewBookmark("http://existing.example", "Existing", ownerID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, _, err := parseNetscapeBookmarks(strings.NewReader(firefoxBookmarks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db().ImportBookmarks(ownerID, nil, tree); err != nil {
+		t.Fatal(err)
+	}
+	otherFolder := int64(-1)
+	if err = db().ImportBookmarks(newUserID, &otherFolder, tree); err != errFolderNotFound {
+		t.Fatalf("expected errFolderNotFound, found %v", err)
+	}
+
+	imported, _, err := loadBookmarkTree(ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Bookmarks) != 3 || *imported.Bookmarks[0].ID != existing {
+		t.Fatal("the imported bookmarks should come after the existing one")
+	}
+	if len(imported.Folders) != 1 || positionOf(imported.Folders[0].Position) <= positionOf(imported.Bookmarks[1].Position) {
+		t.Fatal("the toolbar should come after the first imported bookmark")
+	}
+	toolbar := imported.Folders[0]
+	if len(toolbar.Bookmarks) != 1 || len(toolbar.Folders) != 1 {
+		t.Fatal("the toolbar's contents weren't imported")
+	}
+	strickland := imported.Bookmarks[1]
+	if strickland.CreationDate == nil || strickland.CreationDate.Unix() != 1262304000 {
+		t.Fatal("the bookmark's date wasn't imported")
+	}
+	if len(strickland.Tags) != 2 {
+		t.Fatalf("expected the bookmark's 2 tags to be imported, found %v", strickland.Tags)
+	}
+}
+
+func TestSearchBookmarks(t *testing.T) {
+	ownerID, err := db().CreateUser(NewUser("buck", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBookmark := func(url, title, description string) int64 {
+		b := NewBookmark(url, title, ownerID)
+		b.Description = &description
+		id, err := db().CreateBookmark(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	inTitle := newBookmark("http://strickland.example", "Strickland Propane", "Taste the meat, not the heat")
+	inDescription := newBookmark("http://megalomart.example", "Mega Lo Mart", "Cheap propane, sometimes explosive")
+	newBookmark("http://alamo.example", "Alamo Beer", "")
+	// someone else's bookmark is never found
+	other := NewBookmark("http://propane.example", "Propane", newUserID)
+	if _, err = db().CreateBookmark(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if db().(*SQLiteNewtonDB).fullTextSearch != sqliteFTS5 {
+		t.Fatalf("expected full-text search to be %v with this build", sqliteFTS5)
+	}
+
+	// pages without a search are in a stable order
+	q := NewBookmarkQuery(ownerID)
+	q.PageSize = 2
+	q.Page = 1
+	bookmarks, err := db().Bookmarks(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 1 || *bookmarks[0].URL != "http://alamo.example" {
+		t.Fatal("expected the last bookmark on the second page")
+	}
+
+	q = NewBookmarkQuery(ownerID)
+	q.Search = "propane"
+	bookmarks, err = db().Bookmarks(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 2 {
+		t.Fatalf("expected 2 results, found %d", len(bookmarks))
+	}
+	if *bookmarks[0].ID != inTitle || *bookmarks[1].ID != inDescription {
+		t.Fatal("a match in the title should rank above one in the description")
+	}
+	if bookmarks[0].Rank == nil || bookmarks[1].Rank == nil || *bookmarks[0].Rank <= *bookmarks[1].Rank {
+		t.Fatal("the results weren't ranked")
+	}
+	if bookmarks[1].Snippet == nil || !strings.Contains(*bookmarks[1].Snippet, "<mark>propane</mark>") {
+		t.Fatalf("the match wasn't highlighted in the snippet")
+	}
+
+	// every word has to match, and a word can be the start of one
+	q.Search = "cheap EXPLO"
+	if bookmarks, err = db().Bookmarks(q); err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 1 || *bookmarks[0].ID != inDescription {
+		t.Fatalf("expected only the Mega Lo Mart, found %d results", len(bookmarks))
+	}
+
+	// the index follows edits and deletes
+	bookmark, err := db().Bookmark(inDescription, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	description := "Cheap charcoal"
+	bookmark.Description = &description
+	if err = db().EditBookmark(bookmark); err != nil {
+		t.Fatal(err)
+	}
+	if err = db().DeleteBookmark(inTitle, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	q.Search = "propane"
+	if bookmarks, err = db().Bookmarks(q); err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 0 {
+		t.Fatalf("expected no results after editing and deleting, found %d", len(bookmarks))
+	}
+}
+
+func TestBookmarkMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(propanePage))
+	}))
+	defer server.Close()
+
+	ownerID, err := db().CreateUser(NewUser("bill", testFullName, testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	untitled := &Bookmark{URL: &server.URL, OwnerID: &ownerID}
+	untitledID, err := db().CreateBookmark(untitled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titledID, err := db().CreateBookmark(NewBookmark(server.URL, "My Propane", ownerID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := db().BookmarksPendingMetadata(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *Bookmark
+	for _, b := range pending {
+		if *b.ID == titledID {
+			t.Fatal("bookmarks with a title don't need fetching")
+		}
+		if *b.ID == untitledID {
+			found = b
+		}
+	}
+	if found == nil || *found.Title != "" {
+		t.Fatal("the untitled bookmark should be waiting to be fetched, without a placeholder title")
+	}
+
+	mf := newMetadataFetcher(time.Second, 1<<20, true, true)
+	if err = mf.fetchBookmark(found); err != nil {
+		t.Fatal(err)
+	}
+	bookmark, err := db().Bookmark(untitledID, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *bookmark.Title != "Strickland Propane" || *bookmark.Description != "Taste the meat, not the heat." {
+		t.Fatalf("the title and description weren't filled in: %v", bookmark)
+	}
+	if *bookmark.FaviconURL != server.URL+"/static/icon.png" || *bookmark.CanonicalURL != "https://strickland.example/" {
+		t.Fatalf("the favicon and canonical url weren't saved: %v", bookmark)
+	}
+	if *bookmark.MetadataPending {
+		t.Fatal("the bookmark is still waiting to be fetched")
+	}
+	snapshot, err := db().BookmarkSnapshot(untitledID, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || !strings.HasPrefix(snapshot.Content, "Propane and propane accessories") {
+		t.Fatal("the snapshot wasn't saved")
+	}
+	if snapshot, _ = db().BookmarkSnapshot(untitledID, newUserID); snapshot != nil {
+		t.Fatal("other users shouldn't see the snapshot")
+	}
+
+	// fetching again keeps the user's own title
+	if err = db().RequestBookmarkMetadata(titledID, newUserID); err != errBookmarkNotFound {
+		t.Fatalf("expected errBookmarkNotFound, found %v", err)
+	}
+	if err = db().RequestBookmarkMetadata(titledID, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	titled, err := db().Bookmark(titledID, ownerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*titled.MetadataPending {
+		t.Fatal("the bookmark wasn't queued to be fetched")
+	}
+	if err = mf.fetchBookmark(titled); err != nil {
+		t.Fatal(err)
+	}
+	if titled, _ = db().Bookmark(titledID, ownerID); *titled.Title != "My Propane" || titled.FaviconURL == nil {
+		t.Fatalf("expected only the missing metadata to be filled in: %v", titled)
+	}
+
+	if err = db().DeleteBookmark(untitledID, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, _ = db().BookmarkSnapshot(untitledID, ownerID); snapshot != nil {
+		t.Fatal("the snapshot wasn't deleted with the bookmark")
+	}
 }
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// PageMetadata is what's read from a bookmarked page
+type PageMetadata struct {
+	Title        string
+	Description  string
+	FaviconURL   string
+	CanonicalURL string
+	// Text is the readable text of the page, without its navigation, scripts
+	// and so on
+	Text string
+}
+
+// BookmarkSnapshot is the readable text of a bookmarked page, saved when its
+// metadata was fetched
+type BookmarkSnapshot struct {
+	BookmarkID   int64     `json:"bookmark_id"db:"bookmark_id"`
+	Content      string    `json:"content"db:"content"`
+	CreationDate time.Time `json:"creation_date"db:"creation_date"`
+}
+
+var (
+	// gFetchMetadata turns on the background fetching of bookmarks' pages.
+	// It's off unless the operator chooses to have the server make requests
+	// to the urls users save.
+	gFetchMetadata = false
+	// gFetchTimeout limits how long fetching a page can take, including any
+	// redirects and reading the body
+	gFetchTimeout = 10 * time.Second
+	// gFetchMaxBytes limits how much of a page is read. Anything after that is
+	// ignored, which rarely matters as the metadata is in the head.
+	gFetchMaxBytes = 2 << 20
+	// gStoreSnapshots saves the readable text of each fetched page
+	gStoreSnapshots = false
+
+	gMetadataFetcher *metadataFetcher
+)
+
+const (
+	metadataBatchSize  = 20
+	metadataUserAgent  = "Newton/1.0 (+https://github.com/servletio/newton)"
+	maxMetadataTitle   = 512
+	maxMetadataSummary = 2048
+)
+
+// metadataFetcher fills in the titles and descriptions of bookmarks that were
+// saved without them, one at a time in the background. Which bookmarks need
+// fetching is kept in the database, so nothing is lost on a restart.
+type metadataFetcher struct {
+	client    *http.Client
+	maxBytes  int64
+	snapshots bool
+	wake      chan struct{}
+}
+
+// newMetadataFetcher returns a fetcher that won't connect to any of the
+// blockedNetworks unless allowPrivate is set, so that bookmarks can't be used
+// to probe the network Newton runs in.
+func newMetadataFetcher(timeout time.Duration, maxBytes int64, snapshots, allowPrivate bool) *metadataFetcher {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddresses
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	}
+
+	return &metadataFetcher{
+		client:    &http.Client{Transport: transport, Timeout: timeout},
+		maxBytes:  maxBytes,
+		snapshots: snapshots,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// blockedNetworks are the addresses the fetcher won't connect to: private,
+// shared, loopback, link-local, multicast, documentation and other reserved
+// ranges that aren't part of the public internet
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64", "2001::/23",
+	"2001:db8::/32", "2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func refusePrivateAddresses(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	// IPv4 addresses mapped into IPv6 are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, blocked := range blockedNetworks {
+		if blocked.Contains(ip) {
+			return fmt.Errorf("refusing to connect to %s", host)
+		}
+	}
+	return nil
+}
+
+// notify wakes the fetcher up to look for bookmarks that need fetching
+func (mf *metadataFetcher) notify() {
+	select {
+	case mf.wake <- struct{}{}:
+	default:
+		// it's already been woken up
+	}
+}
+
+// notifyMetadataFetcher is called after bookmarks are added. It does nothing
+// when fetching is turned off.
+func notifyMetadataFetcher() {
+	if gMetadataFetcher != nil {
+		gMetadataFetcher.notify()
+	}
+}
+
+// run fetches the metadata of bookmarks until the program exits
+func (mf *metadataFetcher) run() {
+	for {
+		n, err := mf.fetchPending()
+		if err != nil {
+			logErr(NewtonErr(err))
+		}
+		if err == nil && n == metadataBatchSize {
+			// there may be more
+			continue
+		}
+		<-mf.wake
+	}
+}
+
+// fetchPending fetches the metadata of the next batch of bookmarks that need
+// it, returning how many there were
+func (mf *metadataFetcher) fetchPending() (int, error) {
+	bookmarks, err := db().BookmarksPendingMetadata(metadataBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range bookmarks {
+		if err = mf.fetchBookmark(b); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(bookmarks), nil
+}
+
+// fetchBookmark fetches a bookmark's page and saves what it finds. If the page
+// can't be fetched, the bookmark is still marked as done so that it isn't
+// retried forever.
+func (mf *metadataFetcher) fetchBookmark(b *Bookmark) error {
+	meta, err := mf.fetch(*b.URL)
+	if err != nil {
+		log.Printf("unable to fetch the page of bookmark %d: %v", *b.ID, err)
+		meta = nil
+	}
+	if meta != nil && !mf.snapshots {
+		meta.Text = ""
+	}
+
+	return db().SetBookmarkMetadata(*b.ID, meta)
+}
+
+// fetch downloads a page and reads its metadata
+func (mf *metadataFetcher) fetch(rawURL string) (*PageMetadata, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("can't fetch '%s' urls", u.Scheme)
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", metadataUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := mf.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("the server responded with '%s'", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, err
+		}
+		if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+			return nil, fmt.Errorf("can't read metadata from '%s'", mediaType)
+		}
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, mf.maxBytes), contentType)
+	if err != nil {
+		return nil, err
+	}
+	// relative links are relative to wherever we were redirected to
+	return parsePageMetadata(body, resp.Request.URL)
+}
+
+// parsePageMetadata reads the title, description, favicon, canonical url and
+// readable text out of an HTML page. Links are resolved against base.
+func parsePageMetadata(r io.Reader, base *url.URL) (*PageMetadata, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &PageMetadata{}
+	var ogTitle, ogDescription, ogURL, favicon string
+	var body, article *html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "svg", "math":
+				// their titles aren't the page's
+				return
+			case "title":
+				if meta.Title == "" {
+					meta.Title = nodeText(n)
+				}
+			case "meta":
+				// Open Graph uses property rather than name
+				name := htmlAttr(n, "name")
+				if name == "" {
+					name = htmlAttr(n, "property")
+				}
+				content := htmlAttr(n, "content")
+				switch strings.ToLower(name) {
+				case "description":
+					meta.Description = content
+				case "og:description":
+					ogDescription = content
+				case "og:title":
+					ogTitle = content
+				case "og:url":
+					ogURL = content
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(htmlAttr(n, "rel"))) {
+					switch {
+					case rel == "canonical" && meta.CanonicalURL == "":
+						meta.CanonicalURL = htmlAttr(n, "href")
+					case rel == "icon" && favicon == "":
+						favicon = htmlAttr(n, "href")
+					}
+				}
+			case "body":
+				body = n
+			case "article", "main":
+				if article == nil {
+					article = n
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if meta.Title == "" {
+		meta.Title = ogTitle
+	}
+	if meta.Description == "" {
+		meta.Description = ogDescription
+	}
+	if meta.CanonicalURL == "" {
+		meta.CanonicalURL = ogURL
+	}
+	if favicon == "" {
+		favicon = "/favicon.ico"
+	}
+	meta.Title = truncateRunes(collapseSpaces(meta.Title), maxMetadataTitle)
+	meta.Description = truncateRunes(collapseSpaces(meta.Description), maxMetadataSummary)
+	meta.FaviconURL = resolveURL(base, favicon)
+	meta.CanonicalURL = resolveURL(base, meta.CanonicalURL)
+
+	// the main content is the most readable part, if the page marks it
+	if article != nil {
+		meta.Text = readableText(article)
+	} else if body != nil {
+		meta.Text = readableText(body)
+	}
+
+	return meta, nil
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+// nodeText returns all the text inside a node
+func nodeText(n *html.Node) string {
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return text.String()
+}
+
+// resolveURL makes ref absolute, or returns "" if it isn't a valid http url
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+// readableSkipped are the elements that aren't part of what a page says
+var readableSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+	"math": true, "iframe": true, "nav": true, "header": true, "footer": true,
+	"aside": true, "form": true, "button": true, "select": true,
+}
+
+// readableBlocks are the elements that start a new line
+var readableBlocks = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"section": true, "article": true, "main": true, "blockquote": true,
+	"ul": true, "ol": true, "dl": true, "dt": true, "dd": true, "table": true,
+	"figcaption": true, "hr": true,
+}
+
+// readableText returns the text of a page without its navigation, scripts,
+// forms and so on, with a line for each paragraph
+func readableText(n *html.Node) string {
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			text.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if readableSkipped[n.Data] {
+				return
+			}
+			if readableBlocks[n.Data] {
+				text.WriteString("\n")
+				defer text.WriteString("\n")
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(text.String(), "\n") {
+		if line = collapseSpaces(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
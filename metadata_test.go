@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const propanePage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>
+    Strickland   Propane
+  </title>
+  <meta name="description" content="Taste the meat, not the heat.">
+  <meta property="og:title" content="Strickland Propane | Arlen">
+  <link rel="shortcut icon" href="/static/icon.png">
+  <link rel="canonical" href="https://strickland.example/">
+  <style>body { color: red; }</style>
+</head>
+<body>
+  <nav><a href="/">Home</a> <a href="/grills">Grills</a></nav>
+  <svg><title>Flame</title></svg>
+  <article>
+    <h1>Propane and propane accessories</h1>
+    <p>We sell   propane.<br>And propane accessories.</p>
+    <script>trackVisitor();</script>
+  </article>
+  <footer>Copyright Strickland Propane</footer>
+</body>
+</html>`
+
+func TestParsePageMetadata(t *testing.T) {
+	base, _ := url.Parse("http://strickland.example/about/")
+	meta, err := parsePageMetadata(strings.NewReader(propanePage), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Title != "Strickland Propane" {
+		t.Fatalf("unexpected title %q", meta.Title)
+	}
+	if meta.Description != "Taste the meat, not the heat." {
+		t.Fatalf("unexpected description %q", meta.Description)
+	}
+	if meta.FaviconURL != "http://strickland.example/static/icon.png" {
+		t.Fatalf("unexpected favicon %q", meta.FaviconURL)
+	}
+	if meta.CanonicalURL != "https://strickland.example/" {
+		t.Fatalf("unexpected canonical url %q", meta.CanonicalURL)
+	}
+	expected := "Propane and propane accessories\nWe sell propane.\nAnd propane accessories."
+	if meta.Text != expected {
+		t.Fatalf("expected the text\n%s\nfound\n%s", expected, meta.Text)
+	}
+}
+
+func TestParsePageMetadataFallbacks(t *testing.T) {
+	page := `<html><head>
+<meta property="og:title" content="Mega Lo Mart">
+<meta property="og:description" content="Everything you need">
+<meta property="og:url" content="/home">
+<link rel="icon" href="javascript:alert(1)">
+</head><body><p>Welcome</p></body></html>`
+	base, _ := url.Parse("https://megalomart.example/index.html")
+	meta, err := parsePageMetadata(strings.NewReader(page), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Title != "Mega Lo Mart" || meta.Description != "Everything you need" {
+		t.Fatalf("the Open Graph title and description weren't used: %+v", meta)
+	}
+	if meta.CanonicalURL != "https://megalomart.example/home" {
+		t.Fatalf("unexpected canonical url %q", meta.CanonicalURL)
+	}
+	if meta.FaviconURL != "" {
+		t.Fatalf("only http favicons should be kept, found %q", meta.FaviconURL)
+	}
+	if meta.Text != "Welcome" {
+		t.Fatalf("unexpected text %q", meta.Text)
+	}
+}
+
+func TestFetchPageMetadata(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<title>Caf\xe9</title>"))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Huge</title><p>"))
+		w.Write([]byte(strings.Repeat("propane ", 1<<16)))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mf := newMetadataFetcher(200*time.Millisecond, 1024, true, true)
+	meta, err := mf.fetch(server.URL + "/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Café" {
+		t.Fatalf("the page wasn't decoded from latin-1, found %q", meta.Title)
+	}
+	if meta.FaviconURL != server.URL+"/favicon.ico" {
+		t.Fatalf("expected the default favicon, found %q", meta.FaviconURL)
+	}
+
+	// only the start of a large page is read
+	if meta, err = mf.fetch(server.URL + "/huge"); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Huge" || len(meta.Text) > 1024 {
+		t.Fatalf("expected the page to be cut off, found %d bytes of text", len(meta.Text))
+	}
+
+	for _, path := range []string{"/slow", "/image", "/missing"} {
+		if _, err = mf.fetch(server.URL + path); err == nil {
+			t.Fatalf("expected fetching %s to fail", path)
+		}
+	}
+	if _, err = mf.fetch("ftp://strickland.example/"); err == nil {
+		t.Fatal("expected only http urls to be fetched")
+	}
+
+	// by default the fetcher stays off the local network
+	mf = newMetadataFetcher(200*time.Millisecond, 1024, true, false)
+	if _, err = mf.fetch(server.URL); err == nil || !strings.Contains(err.Error(), "refusing to connect") {
+		t.Fatalf("expected the loopback address to be refused, found %v", err)
+	}
+}
+
+func TestRefusePrivateAddresses(t *testing.T) {
+	refused := []string{
+		"127.0.0.1:80", "10.1.2.3:80", "172.16.0.1:80", "192.168.1.1:80", "100.64.0.1:80",
+		"169.254.169.254:80", "224.0.0.1:80", "255.255.255.255:80", "0.0.0.0:80", "198.18.0.1:80",
+		"[::1]:80", "[fd00::1]:80", "[fe80::1]:80", "[ff02::1]:80", "[::ffff:10.0.0.1]:80",
+	}
+	for _, address := range refused {
+		if refusePrivateAddresses("tcp", address, nil) == nil {
+			t.Errorf("expected %s to be refused", address)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		if err := refusePrivateAddresses("tcp", address, nil); err != nil {
+			t.Errorf("expected %s to be allowed, found %v", address, err)
+		}
+	}
+}
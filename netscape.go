@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	nethtml "golang.org/x/net/html"
+)
+
+const netscapeHeader = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+`
+
+// writeNetscapeBookmarks writes a bookmark tree in the Netscape bookmark file
+// format that every browser can import
+func writeNetscapeBookmarks(w io.Writer, tree *BookmarkTree) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(netscapeHeader)
+	writeNetscapeList(bw, tree.Folders, tree.Bookmarks, 0)
+
+	return bw.Flush()
+}
+
+// writeNetscapeList writes the contents of a folder, with its subfolders and
+// bookmarks interleaved by position
+func writeNetscapeList(bw *bufio.Writer, folders []*BookmarkFolderNode, bookmarks []*Bookmark, depth int) {
+	indent := strings.Repeat("    ", depth)
+	bw.WriteString(indent + "<DL><p>\n")
+	for len(folders) > 0 || len(bookmarks) > 0 {
+		if len(folders) > 0 && (len(bookmarks) == 0 || positionOf(folders[0].Position) <= positionOf(bookmarks[0].Position)) {
+			f := folders[0]
+			folders = folders[1:]
+			bw.WriteString(indent + "    <DT><H3>" + html.EscapeString(*f.Title) + "</H3>\n")
+			writeNetscapeList(bw, f.Folders, f.Bookmarks, depth+1)
+			continue
+		}
+
+		b := bookmarks[0]
+		bookmarks = bookmarks[1:]
+		if b.URL == nil {
+			continue
+		}
+		title := *b.URL
+		if b.Title != nil && *b.Title != "" {
+			title = *b.Title
+		}
+		attrs := `HREF="` + html.EscapeString(*b.URL) + `"`
+		if b.CreationDate != nil {
+			attrs += ` ADD_DATE="` + strconv.FormatInt(b.CreationDate.Unix(), 10) + `"`
+		}
+		if len(b.Tags) > 0 {
+			attrs += ` TAGS="` + html.EscapeString(strings.Join(b.Tags, ",")) + `"`
+		}
+		bw.WriteString(indent + `    <DT><A ` + attrs + `>` + html.EscapeString(title) + "</A>\n")
+		if b.Description != nil && *b.Description != "" {
+			bw.WriteString(indent + "    <DD>" + html.EscapeString(*b.Description) + "\n")
+		}
+	}
+	bw.WriteString(indent + "</DL><p>\n")
+}
+
+// parseNetscapeBookmarks reads a Netscape bookmark file, as exported by any
+// browser, into a tree. Folders and bookmarks are positioned in the order they
+// appear in the file. The ADD_DATE, TAGS and <DD> description of bookmarks
+// are kept when present, though tags that aren't valid are dropped. Bookmarks
+// without a URL are counted in skipped.
+func parseNetscapeBookmarks(r io.Reader) (tree *BookmarkTree, skipped int, err error) {
+	root := newNetscapeFolder("")
+	// the innermost folder is at the end. The file's outer list is the top
+	// level, so root ends up on the stack twice.
+	stack := []*BookmarkFolderNode{root}
+	// pending is a folder whose heading has been read but whose list hasn't
+	// started yet
+	var pending *BookmarkFolderNode
+	// last is the bookmark that a <DD> would describe, and describing is set
+	// while the description's text is being read
+	var last, describing *Bookmark
+	z := nethtml.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			if z.Err() != io.EOF {
+				return nil, 0, z.Err()
+			}
+			break
+		}
+
+		if tt == nethtml.TextToken && describing != nil {
+			description := strings.TrimSpace(valueOrEmpty(describing.Description) + string(z.Text()))
+			describing.Description = &description
+		}
+		if tt != nethtml.StartTagToken && tt != nethtml.EndTagToken {
+			continue
+		}
+		current := stack[len(stack)-1]
+		name, hasAttr := z.TagName()
+		describing = nil
+		switch {
+		case tt == nethtml.StartTagToken && string(name) == "dd":
+			describing = last
+			last = nil
+		case tt == nethtml.StartTagToken && string(name) == "h3":
+			last = nil
+			node := newNetscapeFolder(netscapeText(z, "h3"))
+			position := len(current.Folders) + len(current.Bookmarks)
+			node.Position = &position
+			current.Folders = append(current.Folders, node)
+			pending = node
+		case tt == nethtml.StartTagToken && string(name) == "dl":
+			if pending != nil {
+				current = pending
+				pending = nil
+			}
+			stack = append(stack, current)
+		case tt == nethtml.EndTagToken && string(name) == "dl":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case tt == nethtml.StartTagToken && string(name) == "a":
+			pending, last = nil, nil
+			b := &Bookmark{}
+			var url, tags string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "href":
+					url = strings.TrimSpace(string(val))
+				case "add_date":
+					if secs, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64); err == nil && secs > 0 {
+						date := time.Unix(secs, 0)
+						b.CreationDate = &date
+					}
+				case "tags":
+					tags = string(val)
+				}
+			}
+			title := netscapeText(z, "a")
+			if url == "" {
+				skipped++
+				continue
+			}
+			b.URL, b.Title = &url, &title
+			for _, tag := range strings.Split(tags, ",") {
+				if validateTag(tag) == nil {
+					b.Tags = append(b.Tags, tag)
+				}
+			}
+			b.Tags, _ = cleanTags(b.Tags)
+			position := len(current.Folders) + len(current.Bookmarks)
+			b.Position = &position
+			current.Bookmarks = append(current.Bookmarks, b)
+			last = b
+		}
+	}
+
+	return &BookmarkTree{Folders: root.Folders, Bookmarks: root.Bookmarks}, skipped, nil
+}
+
+func newNetscapeFolder(title string) *BookmarkFolderNode {
+	return &BookmarkFolderNode{
+		BookmarkFolder: &BookmarkFolder{Title: &title},
+		Folders:        []*BookmarkFolderNode{},
+		Bookmarks:      []*Bookmark{},
+	}
+}
+
+// netscapeText reads the text up to the closing tag, which is how the titles
+// of folders and bookmarks are stored
+func netscapeText(z *nethtml.Tokenizer, tag string) string {
+	var text strings.Builder
+	for {
+		switch z.Next() {
+		case nethtml.ErrorToken:
+			return strings.TrimSpace(text.String())
+		case nethtml.TextToken:
+			text.Write(z.Text())
+		case nethtml.EndTagToken:
+			if name, _ := z.TagName(); string(name) == tag {
+				return strings.TrimSpace(text.String())
+			}
+		}
+	}
+}
@@ -16,10 +16,17 @@ func main() {
 	if dbConnect == "" {
 		log.Fatal("You need to specify a string for connecting to the SQL db")
 	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 	err := InitDB(dbConnect)
 	if err != nil {
 		log.Fatalf("Unable to initalize database: %v", err)
 	}
+	if gFetchMetadata {
+		gMetadataFetcher = newMetadataFetcher(gFetchTimeout, int64(gFetchMaxBytes), gStoreSnapshots, false)
+		go gMetadataFetcher.run()
+	}
 
 	r := mux.NewRouter()
 	r.Methods("OPTIONS").HandlerFunc(corsHandler)
@@ -40,16 +47,47 @@ func main() {
 
 func installEndpoints(router *mux.Router) {
 	router.Handle("/sessions", NewtonFunc(CreateSessionHandler)).Methods("POST")
+	router.Handle("/sessions", NewtonFunc(GetSessionsHandler)).Methods("GET")
+	router.Handle("/sessions/refresh", NewtonFunc(RefreshSessionHandler)).Methods("POST")
+	router.Handle("/sessions/totp", NewtonFunc(CompleteTOTPChallengeHandler)).Methods("POST")
+	router.Handle("/sessions/current", NewtonFunc(DeleteCurrentSessionHandler)).Methods("DELETE")
+	router.Handle("/sessions/{session_id:[0-9]+}", NewtonFunc(DeleteSessionHandler)).Methods("DELETE")
+
+	router.Handle("/password_resets", NewtonFunc(CreatePasswordResetHandler)).Methods("POST")
+	router.Handle("/password_resets/complete", NewtonFunc(CompletePasswordResetHandler)).Methods("POST")
 
 	router.Handle("/users", NewtonFunc(CreateUserHandler)).Methods("POST")
 	router.Handle("/users/{user_id}", NewtonFunc(GetUserHandler)).Methods("GET")
 	router.Handle("/users/{user_id}", NewtonFunc(EditUserHandler)).Methods("PUT")
+	router.Handle("/users/{user_id}", NewtonFunc(DeleteUserHandler)).Methods("DELETE")
+	router.Handle("/users/{user_id}/password", NewtonFunc(ChangePasswordHandler)).Methods("PUT")
+	router.Handle("/users/{user_id}/export", NewtonFunc(ExportUserHandler)).Methods("GET")
+	router.Handle("/users/{user_id}/totp", NewtonFunc(EnrollTOTPHandler)).Methods("POST")
+	router.Handle("/users/{user_id}/totp", NewtonFunc(DisableTOTPHandler)).Methods("DELETE")
+	router.Handle("/users/{user_id}/totp/confirm", NewtonFunc(ConfirmTOTPHandler)).Methods("POST")
+	router.Handle("/users/{user_id}/totp/recovery_codes", NewtonFunc(RegenerateRecoveryCodesHandler)).Methods("POST")
 
 	router.Handle("/bookmarks", NewtonFunc(CreateBookmarkHandler)).Methods("POST")
 	router.Handle("/bookmarks", NewtonFunc(GetBookmarksHandler)).Methods("GET")
+	router.Handle("/bookmarks/import", NewtonFunc(ImportBookmarksHandler)).Methods("POST")
+	router.Handle("/bookmarks/export", NewtonFunc(ExportBookmarksHandler)).Methods("GET")
 	router.Handle("/bookmarks/{bookmark_id}", NewtonFunc(GetBookmarkHandler)).Methods("GET")
 	router.Handle("/bookmarks/{bookmark_id}", NewtonFunc(EditBookmarkHandler)).Methods("PUT")
 	router.Handle("/bookmarks/{bookmark_id}", NewtonFunc(DeleteBookmarkHandler)).Methods("DELETE")
+	router.Handle("/bookmarks/{bookmark_id}/move", NewtonFunc(MoveBookmarkHandler)).Methods("POST")
+	router.Handle("/bookmarks/{bookmark_id}/metadata", NewtonFunc(RefreshBookmarkMetadataHandler)).Methods("POST")
+	router.Handle("/bookmarks/{bookmark_id}/snapshot", NewtonFunc(GetBookmarkSnapshotHandler)).Methods("GET")
+
+	router.Handle("/tags", NewtonFunc(GetTagsHandler)).Methods("GET")
+	router.Handle("/tags/merge", NewtonFunc(MergeTagsHandler)).Methods("POST")
+	router.Handle("/tags/{tag_id:[0-9]+}", NewtonFunc(RenameTagHandler)).Methods("PUT")
+
+	router.Handle("/folders", NewtonFunc(CreateBookmarkFolderHandler)).Methods("POST")
+	router.Handle("/folders/tree", NewtonFunc(GetBookmarkFolderTreeHandler)).Methods("GET")
+	router.Handle("/folders/{folder_id:[0-9]+}", NewtonFunc(GetBookmarkFolderHandler)).Methods("GET")
+	router.Handle("/folders/{folder_id:[0-9]+}", NewtonFunc(EditBookmarkFolderHandler)).Methods("PUT")
+	router.Handle("/folders/{folder_id:[0-9]+}", NewtonFunc(DeleteBookmarkFolderHandler)).Methods("DELETE")
+	router.Handle("/folders/{folder_id:[0-9]+}/move", NewtonFunc(MoveBookmarkFolderHandler)).Methods("POST")
 
 	router.Handle("/contacts", NewtonFunc(CreateContactHandler)).Methods("POST")
 	router.Handle("/contacts", NewtonFunc(GetContactsHandler)).Methods("GET")
@@ -58,7 +96,14 @@ func installEndpoints(router *mux.Router) {
 	router.Handle("/contacts/{contact_id}/photo", NewtonFunc(GetContactPhotoHandler)).Methods("GET")
 	router.Handle("/contacts/{contact_id}/photo", NewtonFunc(DeleteContactPhotoHandler)).Methods("DELETE")
 
-	router.Handle("/locations", NewtonFunc(CreateLocationEntry)).Methods("POST")
+	router.Handle("/locations", NewtonFunc(CreateLocationRecordsHandler)).Methods("POST")
+	router.Handle("/locations", NewtonFunc(GetLocationRecordsHandler)).Methods("GET")
+	router.Handle("/locations/bulk", NewtonFunc(BulkCreateLocationRecordsHandler)).Methods("POST")
+	router.Handle("/locations/import", NewtonFunc(ImportLocationRecordsHandler)).Methods("POST")
+	router.Handle("/locations/simplified", NewtonFunc(GetSimplifiedLocationRecordsHandler)).Methods("GET")
+	router.Handle("/locations/trips", NewtonFunc(GetLocationSegmentsHandler)).Methods("GET")
+	router.Handle("/locations/gpx", NewtonFunc(ExportLocationRecordsGPXHandler)).Methods("GET")
+	router.Handle("/locations/geojson", NewtonFunc(ExportLocationRecordsGeoJSONHandler)).Methods("GET")
 }
 
 func corsHandler(w http.ResponseWriter, r *http.Request) {
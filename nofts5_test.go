@@ -0,0 +1,7 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package main
+
+// sqliteFTS5 is whether the tests were built with FTS5. See fts5_test.go.
+const sqliteFTS5 = false
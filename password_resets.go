@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PasswordReset is a single use token that lets a user set a new password
+// without knowing the current one. Only the hash of the token is stored.
+type PasswordReset struct {
+	ID             *int64    `db:"id"`
+	UserID         int64     `db:"user_id"`
+	TokenHash      string    `db:"token_hash"`
+	CreationDate   time.Time `db:"creation_date"`
+	ExpirationDate time.Time `db:"expiration_date"`
+	Used           bool      `db:"used"`
+}
+
+// gPasswordResetLifetime is how long a password reset token can be used for
+var gPasswordResetLifetime = time.Hour
+
+// gPasswordResetURL is the page that users are sent to from the reset email.
+// The token is added to it as the 'token' query parameter. If it's empty, the
+// email just contains the token.
+var gPasswordResetURL string
+
+// gPasswordResetThrottle limits how many reset emails an account can be sent
+var gPasswordResetThrottle = newLoginThrottle(3, 10, time.Minute, 24*time.Hour)
+
+// passwordResetBody is the text of a password reset email
+func passwordResetBody(user *User, token string) string {
+	var link string
+	if gPasswordResetURL != "" {
+		if u, err := url.Parse(gPasswordResetURL); err == nil {
+			q := u.Query()
+			q.Set("token", token)
+			u.RawQuery = q.Encode()
+			link = u.String()
+		}
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your Newton account '%s'.\n\n", *user.FullName, *user.Username)
+	if link != "" {
+		body += "To choose a new password, go to:\n\n" + link + "\n\n"
+	} else {
+		body += "To choose a new password, use this code:\n\n" + token + "\n\n"
+	}
+	body += fmt.Sprintf("This expires in %v. If you didn't ask for this, you can ignore this email.\n", gPasswordResetLifetime)
+	return body
+}
+
+// CreatePasswordResetHandler handles POST /password_resets
+//
+// It emails a reset token to the account matching the 'username', or to every
+// account with the 'email'. The response is the same whether or not a
+// matching account exists, so it can't be used to find out who has an
+// account.
+func CreatePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if gMailer == nil {
+		sendBadReq(w, "password resets are turned off")
+		return
+	}
+
+	body := struct {
+		Username *string `json:"username,omitempty"`
+		Email    *string `json:"email,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+
+	var users []*User
+	switch {
+	case body.Username != nil && *body.Username != "":
+		user, err := db().UserByUsername(*body.Username)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		if user != nil {
+			users = append(users, user)
+		}
+	case body.Email != nil && *body.Email != "":
+		var err error
+		if users, err = db().UsersByEmail(strings.TrimSpace(*body.Email)); err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	default:
+		sendBadReq(w, "you need to specify a 'username' or an 'email'")
+		return
+	}
+
+	now := time.Now()
+	for _, user := range users {
+		if err := sendPasswordReset(user, now); err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	}
+
+	sendSuccess(w, nil)
+}
+
+// sendPasswordReset creates a reset token for user and emails it to them, as
+// long as they have an email address and haven't been sent too many already
+func sendPasswordReset(user *User, now time.Time) error {
+	if user.Email == nil || *user.Email == "" {
+		return nil
+	}
+	throttleKey := fmt.Sprint(*user.ID)
+	if gPasswordResetThrottle.wait(throttleKey, now) > 0 {
+		// quietly drop it, rather than flood the user's inbox
+		return nil
+	}
+	gPasswordResetThrottle.fail(throttleKey, now)
+
+	token := randAlphaNum(40)
+	reset := &PasswordReset{
+		UserID:         *user.ID,
+		TokenHash:      hashToken(token),
+		CreationDate:   now,
+		ExpirationDate: now.Add(gPasswordResetLifetime),
+	}
+	if err := db().CreatePasswordReset(reset); err != nil {
+		return err
+	}
+
+	// sending can be slow, and waiting for it would reveal that the
+	// account exists
+	to, msg := *user.Email, passwordResetBody(user, token)
+	go func() {
+		if err := gMailer.Send(to, "Reset your Newton password", msg); err != nil {
+			logErr(NewtonErr(err))
+		}
+	}()
+
+	return nil
+}
+
+// CompletePasswordResetHandler handles POST /password_resets/complete
+//
+// It sets a new password using a reset token, and logs the user out
+// everywhere.
+func CompletePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Token       *string `json:"token,omitempty"`
+		NewPassword *string `json:"new_password,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.Token == nil || *body.Token == "" {
+		sendBadReq(w, "you need to specify the 'token'")
+		return
+	}
+	if body.NewPassword == nil {
+		sendBadReq(w, "you need to specify a 'new_password'")
+		return
+	}
+
+	now := time.Now()
+	tokenHash := hashToken(strings.TrimSpace(*body.Token))
+	userID, err := db().PasswordResetUserID(tokenHash, now)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if userID == 0 {
+		sendUnauthorized(w, "this password reset 'token' is invalid or has expired")
+		return
+	}
+	user, err := db().User(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if user == nil {
+		sendUnauthorized(w, "this password reset 'token' is invalid or has expired")
+		return
+	}
+
+	if err = validatePassword(*body.NewPassword, *user.Username); err != nil {
+		sendBadReq(w, strings.Replace(err.Error(), "'password'", "'new_password'", 1))
+		return
+	}
+	hash, err := hashPassword(*body.NewPassword)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	reset, err := db().ResetPassword(tokenHash, hash, now)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !reset {
+		// someone else used the token in the meantime
+		sendUnauthorized(w, "this password reset 'token' is invalid or has expired")
+		return
+	}
+	recordLoginSuccess(*user.Username, r)
+
+	sendSuccess(w, nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHasher hashes passwords for storage and checks passwords against
+// stored hashes. Verify reports needsRehash when the password matched, but the
+// hash should be replaced because it was made with different settings (or a
+// different algorithm) than the ones currently in use.
+type passwordHasher interface {
+	Hash(password string) (string, error)
+	Verify(hash, password string) (match bool, needsRehash bool, err error)
+}
+
+// gBcryptCost is the bcrypt cost used for new password hashes
+var gBcryptCost = bcrypt.DefaultCost
+
+// gPasswordHasher hashes all new passwords
+var gPasswordHasher passwordHasher = bcryptHasher{}
+
+type bcryptHasher struct{}
+
+func (bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), gBcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (bcryptHasher) Verify(hash, password string) (bool, bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, err
+	}
+	return true, cost != gBcryptCost, nil
+}
+
+// isBcryptHash reports whether hash was produced by bcrypt
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// hashPassword hashes a password for storage
+func hashPassword(password string) (string, error) {
+	return gPasswordHasher.Hash(password)
+}
+
+// verifyPassword checks password against a stored hash, using whichever
+// hasher produced it. A matching hash that wasn't produced by gPasswordHasher
+// always needsRehash, and a hash that no hasher recognizes never matches.
+func verifyPassword(hash, password string) (match bool, needsRehash bool, err error) {
+	// bcrypt is the only algorithm so far. Another one (e.g. argon2id) can be
+	// added by giving it a hasher and recognizing its hashes here, by prefix.
+	if !isBcryptHash(hash) {
+		return false, false, nil
+	}
+	match, needsRehash, err = bcryptHasher{}.Verify(hash, password)
+	if _, current := gPasswordHasher.(bcryptHasher); match && !current {
+		needsRehash = true
+	}
+	return match, needsRehash, err
+}
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores anything past 72 bytes
+	maxPasswordLength = 72
+)
+
+// validatePassword checks a new password against the password policy
+func validatePassword(password, username string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Errorf("the 'password' needs to be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("the 'password' can't be longer than %d bytes", maxPasswordLength)
+	}
+	if strings.TrimSpace(password) == "" {
+		return errors.New("the 'password' can't be blank")
+	}
+	if strings.EqualFold(password, username) {
+		return errors.New("the 'password' can't be the same as the username")
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	defer func(cost int) { gBcryptCost = cost }(gBcryptCost)
+	gBcryptCost = bcrypt.MinCost
+
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, needsRehash, err := verifyPassword(hash, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match || needsRehash {
+		t.Fatalf("expected a match without a rehash, found %v, %v", match, needsRehash)
+	}
+	if match, _, _ = verifyPassword(hash, "battery staple"); match {
+		t.Fatal("the wrong password matched")
+	}
+
+	// raising the cost means existing hashes should be replaced on login
+	gBcryptCost = bcrypt.MinCost + 1
+	match, needsRehash, err = verifyPassword(hash, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match || !needsRehash {
+		t.Fatalf("expected a match that needs a rehash, found %v, %v", match, needsRehash)
+	}
+
+	// so should hashes made by a hasher that's no longer the current one
+	defer func(hasher passwordHasher) { gPasswordHasher = hasher }(gPasswordHasher)
+	gBcryptCost = bcrypt.MinCost
+	gPasswordHasher = otherHasher{}
+	if match, needsRehash, _ = verifyPassword(hash, "correct horse"); !match || !needsRehash {
+		t.Fatalf("expected a match that needs a rehash, found %v, %v", match, needsRehash)
+	}
+
+	if match, _, _ = verifyPassword("not a hash", "not a hash"); match {
+		t.Fatal("an unrecognized hash matched")
+	}
+}
+
+// otherHasher stands in for a hasher other than bcrypt
+type otherHasher struct{}
+
+func (otherHasher) Hash(password string) (string, error) {
+	return "", nil
+}
+
+func (otherHasher) Verify(hash, password string) (bool, bool, error) {
+	return false, false, nil
+}
+
+func TestValidatePassword(t *testing.T) {
+	if err := validatePassword("short", "hank"); err == nil {
+		t.Fatal("a short password was accepted")
+	}
+	if err := validatePassword("HankHill", "hankhill"); err == nil {
+		t.Fatal("the username was accepted as the password")
+	}
+	if err := validatePassword("        ", "hank"); err == nil {
+		t.Fatal("a blank password was accepted")
+	}
+	if err := validatePassword("propane and propane accessories", "hank"); err != nil {
+		t.Fatal(err)
+	}
+}
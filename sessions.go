@@ -1,61 +1,222 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/gorilla/mux"
 )
 
 // Session contains the fields used in managing a user's authentication
 type Session struct {
-	ID           *int64     `json:"id,omitempty"db:"id"`
-	AccessToken  *string    `json:"access_token,omitempty"db:"access_token"`
-	UserID       *int64     `json:"user_id,omitempty"db:"user_id"`
-	CreationDate *time.Time `json:"creation_date,omitempty"db:"creation_date"`
+	ID                        *int64     `json:"id,omitempty"db:"id"`
+	AccessToken               *string    `json:"access_token,omitempty"db:"-"`
+	AccessTokenHash           *string    `json:"-"db:"access_token_hash"`
+	AccessTokenExpirationDate *time.Time `json:"access_token_expiration_date,omitempty"db:"access_token_expiration_date"`
+	RefreshToken              *string    `json:"refresh_token,omitempty"db:"-"`
+	RefreshTokenHash          *string    `json:"-"db:"refresh_token_hash"`
+	UserID                    *int64     `json:"user_id,omitempty"db:"user_id"`
+	CreationDate              *time.Time `json:"creation_date,omitempty"db:"creation_date"`
+	LastUsedDate              *time.Time `json:"last_used_date,omitempty"db:"last_used_date"`
+	UserAgent                 *string    `json:"user_agent,omitempty"db:"user_agent"`
+	Device                    *string    `json:"device,omitempty"db:"device"`
+	Current                   bool       `json:"current,omitempty"db:"-"`
 }
 
-// NewSession creates a session, and generates an access token and creation date
+// gSessionIdleTimeout is how long a session can go unused before it expires.
+// Zero disables the check.
+var gSessionIdleTimeout = 30 * 24 * time.Hour
+
+// gSessionMaxAge is how long a session lasts after it's created, regardless of
+// use. Zero disables the check.
+var gSessionMaxAge = 365 * 24 * time.Hour
+
+// gAccessTokenLifetime is how long an access token can be used before it has
+// to be exchanged for a new one using the session's refresh token
+var gAccessTokenLifetime = time.Hour
+
+// sessionTouchInterval limits how often a session's last used date is written
+// back to the database
+const sessionTouchInterval = time.Minute
+
+// NewSession creates a session, and generates an access token, refresh token
+// and creation date
 func NewSession(userID int64) *Session {
 	session := &Session{UserID: &userID}
 	now := time.Now()
 	session.CreationDate = &now
-	token := randAlphaNum(32)
-	session.AccessToken = &token
+	session.LastUsedDate = &now
+	session.issueTokens(now)
 
 	return session
 }
 
-func authenticate(w http.ResponseWriter, r *http.Request) (int64, bool) {
-	args := r.URL.Query()
-	accessToken := args.Get("access_token")
-	token := strings.TrimSpace(accessToken)
+// issueTokens replaces the session's access and refresh tokens with new ones
+func (s *Session) issueTokens(now time.Time) {
+	accessToken := randAlphaNum(32)
+	accessHash := hashToken(accessToken)
+	s.AccessToken = &accessToken
+	s.AccessTokenHash = &accessHash
+	expiration := now.Add(gAccessTokenLifetime)
+	s.AccessTokenExpirationDate = &expiration
+
+	refreshToken := randAlphaNum(48)
+	refreshHash := hashToken(refreshToken)
+	s.RefreshToken = &refreshToken
+	s.RefreshTokenHash = &refreshHash
+}
+
+// gTokenKey is the HMAC key used to hash tokens before they're stored.
+// The tokens are random enough that the hashes can't be reversed even without
+// a key, but setting one means a copy of the database alone isn't enough to
+// check a guessed token.
+var gTokenKey []byte
+
+// hashToken returns the hex encoded HMAC-SHA256 of token. Only the hash of an
+// access or refresh token is ever stored.
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, gTokenKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Expired reports whether the session has exceeded the idle or absolute
+// lifetime
+func (s *Session) Expired(now time.Time) bool {
+	if gSessionMaxAge > 0 && s.CreationDate != nil && now.Sub(*s.CreationDate) > gSessionMaxAge {
+		return true
+	}
+	lastUsed := s.LastUsedDate
+	if lastUsed == nil {
+		lastUsed = s.CreationDate
+	}
+	if gSessionIdleTimeout > 0 && lastUsed != nil && now.Sub(*lastUsed) > gSessionIdleTimeout {
+		return true
+	}
+
+	return false
+}
+
+// gAllowQueryAccessToken controls whether the legacy 'access_token' query
+// parameter is accepted. Tokens in URLs end up in proxy and access logs, so
+// it's off unless older clients need it, and clients should send an
+// 'Authorization: Bearer' header instead.
+var gAllowQueryAccessToken = false
+
+// accessTokenFromRequest extracts the access token from the Authorization
+// header, falling back to the 'access_token' query parameter when allowed. It
+// returns an empty string if no token was provided.
+func accessTokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", errors.New("the Authorization header must use the Bearer scheme")
+		}
+		return strings.TrimSpace(parts[1]), nil
+	}
+
+	if gAllowQueryAccessToken {
+		return strings.TrimSpace(r.URL.Query().Get("access_token")), nil
+	}
+
+	return "", nil
+}
+
+func sendAuthRequired(w http.ResponseWriter, msg string, invalidToken bool) {
+	challenge := `Bearer realm="newton"`
+	if invalidToken {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	sendUnauthorized(w, msg)
+}
+
+// authenticateSession returns the session belonging to the request's access
+// token. If there isn't a valid session, an error response is sent and false
+// is returned.
+func authenticateSession(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	token, err := accessTokenFromRequest(r)
+	if err != nil {
+		sendAuthRequired(w, err.Error(), true)
+		return nil, false
+	}
 	if token == "" {
-		sendUnauthorized(w, "you need to be logged in to continue")
-		return 0, false
+		sendAuthRequired(w, "you need to be logged in to continue", false)
+		return nil, false
 	}
 
-	session, err := db().SessionByAccessToken(token)
+	session, err := db().SessionByAccessTokenHash(hashToken(token))
 	if err != nil {
 		sendInternalErr(w, err)
-		return 0, false
+		return nil, false
 	}
 
 	if session == nil {
-		sendUnauthorized(w, "you need to be logged in to continue")
+		sendAuthRequired(w, "you need to be logged in to continue", true)
+		return nil, false
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		if err = db().DeleteSession(*session.ID, *session.UserID); err != nil {
+			logErr(NewtonErr(err))
+		}
+		sendAuthRequired(w, "your session has expired", true)
+		return nil, false
+	}
+	// sessions created before refresh tokens existed have no expiration date
+	if session.AccessTokenExpirationDate != nil && now.After(*session.AccessTokenExpirationDate) {
+		sendAuthRequired(w, "your access token has expired", true)
+		return nil, false
+	}
+
+	if session.LastUsedDate == nil || now.Sub(*session.LastUsedDate) > sessionTouchInterval {
+		if err = db().TouchSession(*session.ID, now); err != nil {
+			// not worth failing the request over
+			logErr(NewtonErr(err))
+		}
+		session.LastUsedDate = &now
+	}
+
+	return session, true
+}
+
+func authenticate(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	session, ok := authenticateSession(w, r)
+	if !ok {
 		return 0, false
 	}
 
 	return *session.UserID, true
 }
 
+func parseSessionID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	vars := mux.Vars(r)
+	idStr := vars["session_id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		sendBadReq(w, "invalid session id")
+		return 0, false
+	}
+
+	return id, true
+}
+
 // CreateSessionHandler handles POST /sessions
 func CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 	userAndPass := struct {
 		Username *string `json:"username,omitempty"`
 		Password *string `json:"password,omitempty"`
+		Device   *string `json:"device,omitempty"`
 	}{}
 
 	dec := json.NewDecoder(r.Body)
@@ -74,24 +235,82 @@ func CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now()
+	attempt, wait := beginLoginAttempt(*userAndPass.Username, r, now)
+	if wait > 0 {
+		sendTooManyRequests(w, "too many failed login attempts; try again later", wait)
+		return
+	}
+	defer attempt.release()
+
 	user, err := db().UserByUsername(*userAndPass.Username)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
 	if user == nil {
+		attempt.failed()
 		sendUnauthorized(w, "incorrect 'username' and/or 'password'")
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(*user.Password), []byte(*userAndPass.Password))
+	match, needsRehash, err := verifyPassword(*user.Password, *userAndPass.Password)
 	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !match {
+		attempt.failed()
 		sendUnauthorized(w, "incorrect 'username' and/or 'password'")
 		return
 	}
+	if needsRehash {
+		// this is the only time we have the plaintext password, so upgrade
+		// the hash to the current settings now. Logging in still works with
+		// the old hash if it fails.
+		if hash, err := hashPassword(*userAndPass.Password); err != nil {
+			logErr(NewtonErr(err))
+		} else if err = db().SetUserPassword(*user.ID, hash); err != nil {
+			logErr(NewtonErr(err))
+		}
+	}
+
+	var userAgent, device *string
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		ua = truncateString(ua, 256)
+		userAgent = &ua
+	}
+	if userAndPass.Device != nil {
+		d := truncateString(*userAndPass.Device, 128)
+		device = &d
+	}
+
+	// users with two-factor authentication need to complete a challenge
+	// before they get a session
+	totp, err := db().UserTOTP(*user.ID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if totp != nil && totp.Confirmed {
+		token := gTOTPChallenges.add(&totpChallenge{
+			userID:    *user.ID,
+			username:  *userAndPass.Username,
+			userAgent: userAgent,
+			device:    device,
+		}, now)
+		sendSuccess(w, struct {
+			TOTPRequired   bool   `json:"totp_required"`
+			ChallengeToken string `json:"challenge_token"`
+		}{TOTPRequired: true, ChallengeToken: token})
+		return
+	}
+	attempt.succeeded()
 
 	// make a new session, persist it, then return it
 	session := NewSession(*user.ID)
+	session.UserAgent = userAgent
+	session.Device = device
 	sessionID, err := db().CreateSession(session)
 	if err != nil {
 		sendInternalErr(w, err)
@@ -101,3 +320,149 @@ func CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 
 	sendSuccess(w, session)
 }
+
+// RefreshSessionHandler handles POST /sessions/refresh
+//
+// A refresh token can be exchanged exactly once for a new access token and a
+// new refresh token. Presenting a refresh token that has already been used
+// means it has leaked, so the whole session is revoked.
+func RefreshSessionHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		RefreshToken *string `json:"refresh_token,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.RefreshToken == nil || *body.RefreshToken == "" {
+		sendBadReq(w, "you need to specify a 'refresh_token'")
+		return
+	}
+
+	refreshHash := hashToken(*body.RefreshToken)
+	session, err := db().SessionByRefreshTokenHash(refreshHash)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if session == nil {
+		revokeReusedRefreshToken(w, refreshHash)
+		return
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		if err = db().DeleteSession(*session.ID, *session.UserID); err != nil {
+			logErr(NewtonErr(err))
+		}
+		sendUnauthorized(w, "your session has expired")
+		return
+	}
+
+	session.issueTokens(now)
+	session.LastUsedDate = &now
+	rotated, err := db().RotateSessionTokens(session, refreshHash)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !rotated {
+		// another request used the same refresh token first
+		revokeReusedRefreshToken(w, refreshHash)
+		return
+	}
+
+	sendSuccess(w, session)
+}
+
+// revokeReusedRefreshToken deletes the session that a retired refresh token
+// belonged to, if any, and sends an unauthorized response
+func revokeReusedRefreshToken(w http.ResponseWriter, refreshHash string) {
+	sessionID, userID, err := db().SessionByRetiredRefreshTokenHash(refreshHash)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if sessionID == 0 {
+		sendUnauthorized(w, "invalid 'refresh_token'")
+		return
+	}
+
+	log.Printf("refresh token reuse detected; revoking session %d of user %d", sessionID, userID)
+	if err = db().DeleteSession(sessionID, userID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendUnauthorized(w, "this 'refresh_token' has already been used, so the session has been revoked")
+}
+
+// GetSessionsHandler handles GET /sessions
+func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	current, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := db().SessionsByUserID(*current.UserID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	now := time.Now()
+	active := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		if session.Expired(now) {
+			continue
+		}
+		session.Current = *session.ID == *current.ID
+		active = append(active, session)
+	}
+
+	sendSuccess(w, active)
+}
+
+// DeleteSessionHandler handles DELETE /sessions/{session_id}
+func DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	sessionID, ok := parseSessionID(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := db().Session(sessionID, userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if session == nil {
+		sendNotFound(w, fmt.Sprintf("session %d not found", sessionID))
+		return
+	}
+
+	if err = db().DeleteSession(sessionID, userID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
+
+// DeleteCurrentSessionHandler handles DELETE /sessions/current
+func DeleteCurrentSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db().DeleteSession(*session.ID, *session.UserID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
@@ -4,11 +4,14 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // DropAllMariaDBTables is just useful when testing
@@ -38,7 +41,7 @@ CREATE TABLE IF NOT EXISTS database_version (id INTEGER PRIMARY KEY NOT NULL,
 const CreateTableBookmarks = `
 CREATE TABLE IF NOT EXISTS bookmarks (id INTEGER PRIMARY KEY,
                                       url TEXT NOT NULL,
-									  title TEXT NOT NULL DEFAULT "title",
+									  title TEXT NOT NULL DEFAULT '',
 									  owner_id INTEGER NOT NULL)`
 
 // CreateTableUsers is the statement to create the users table
@@ -155,6 +158,98 @@ CREATE TABLE IF NOT EXISTS location_records (timestamp INTEGER NOT NULL,
 											owner_id INTEGER NOT NULL,
 											PRIMARY KEY (timestamp, owner_id))`
 
+// CreateIndexLocationRecordsOwnerTimestamp speeds up retrieving a user's location records by time
+const CreateIndexLocationRecordsOwnerTimestamp = `
+CREATE INDEX IF NOT EXISTS location_records_owner_timestamp ON location_records (owner_id, timestamp)`
+
+// CreateIndexLocationRecordsOwnerPosition speeds up retrieving a user's location records within a bounding box
+const CreateIndexLocationRecordsOwnerPosition = `
+CREATE INDEX IF NOT EXISTS location_records_owner_position ON location_records (owner_id, latitude, longitude)`
+
+// CreateTableRetiredRefreshTokens creates the table for remembering the refresh tokens that have already been exchanged
+const CreateTableRetiredRefreshTokens = `
+CREATE TABLE IF NOT EXISTS retired_refresh_tokens (token_hash TEXT PRIMARY KEY NOT NULL,
+                                                   session_id INTEGER NOT NULL)`
+
+// CreateTableUserTOTP is the statement to create the table of users' two-factor authentication secrets
+const CreateTableUserTOTP = `
+CREATE TABLE IF NOT EXISTS user_totp (user_id INTEGER PRIMARY KEY NOT NULL,
+                                      secret TEXT NOT NULL,
+                                      confirmed BOOLEAN NOT NULL DEFAULT 0,
+                                      last_counter INTEGER NOT NULL DEFAULT 0,
+                                      creation_date TIMESTAMP NOT NULL)`
+
+// CreateTableRecoveryCodes is the statement to create the table of hashed two-factor recovery codes
+const CreateTableRecoveryCodes = `
+CREATE TABLE IF NOT EXISTS recovery_codes (code_hash TEXT NOT NULL,
+                                           user_id INTEGER NOT NULL,
+                                           PRIMARY KEY (user_id, code_hash))`
+
+// CreateTablePasswordResets is the statement to create the table of password reset tokens
+const CreateTablePasswordResets = `
+CREATE TABLE IF NOT EXISTS password_resets (id INTEGER PRIMARY KEY NOT NULL,
+                                            user_id INTEGER NOT NULL,
+                                            token_hash TEXT NOT NULL UNIQUE,
+                                            creation_date TIMESTAMP NOT NULL,
+                                            expiration_date TIMESTAMP NOT NULL,
+                                            used BOOLEAN NOT NULL DEFAULT 0)`
+
+// CreateTableBookmarkFolders is the statement to create the bookmark folders table
+const CreateTableBookmarkFolders = `
+CREATE TABLE IF NOT EXISTS bookmark_folders (id INTEGER PRIMARY KEY NOT NULL,
+                                             title TEXT NOT NULL,
+                                             parent_id INTEGER,
+                                             position INTEGER NOT NULL DEFAULT 0,
+                                             owner_id INTEGER NOT NULL)`
+
+// CreateTableTags is the statement to create the table of users' bookmark tags
+const CreateTableTags = `
+CREATE TABLE IF NOT EXISTS tags (id INTEGER PRIMARY KEY NOT NULL,
+                                 name TEXT NOT NULL,
+                                 name_normalized TEXT NOT NULL,
+                                 owner_id INTEGER NOT NULL,
+                                 UNIQUE (owner_id, name_normalized))`
+
+// CreateTableBookmarkTags is the statement to create the table linking bookmarks and tags
+const CreateTableBookmarkTags = `
+CREATE TABLE IF NOT EXISTS bookmark_tags (bookmark_id INTEGER NOT NULL,
+                                          tag_id INTEGER NOT NULL,
+                                          PRIMARY KEY (bookmark_id, tag_id))`
+
+// CreateTableBookmarkSnapshots is the statement to create the table of the
+// readable text of bookmarked pages
+const CreateTableBookmarkSnapshots = `
+CREATE TABLE IF NOT EXISTS bookmark_snapshots (bookmark_id INTEGER PRIMARY KEY NOT NULL,
+                                               content TEXT NOT NULL,
+                                               creation_date TIMESTAMP NOT NULL)`
+
+// CreateTableBookmarksFTS is the statement to create the full-text index of
+// bookmarks. It's an external content table, so the text is only stored once,
+// in the bookmarks table.
+const CreateTableBookmarksFTS = `
+CREATE VIRTUAL TABLE IF NOT EXISTS bookmarks_fts USING fts5(url,
+                                                           title,
+                                                           description,
+                                                           content='bookmarks',
+                                                           content_rowid='id')`
+
+// bookmarksFTSTriggers keep the full-text index in step with the bookmarks
+var bookmarksFTSTriggers = map[string]string{
+	"bookmarks_fts_insert": `
+CREATE TRIGGER bookmarks_fts_insert AFTER INSERT ON bookmarks BEGIN
+    INSERT INTO bookmarks_fts (rowid, url, title, description) VALUES (new.id, new.url, new.title, new.description);
+END`,
+	"bookmarks_fts_delete": `
+CREATE TRIGGER bookmarks_fts_delete AFTER DELETE ON bookmarks BEGIN
+    INSERT INTO bookmarks_fts (bookmarks_fts, rowid, url, title, description) VALUES ('delete', old.id, old.url, old.title, old.description);
+END`,
+	"bookmarks_fts_update": `
+CREATE TRIGGER bookmarks_fts_update AFTER UPDATE OF url, title, description ON bookmarks BEGIN
+    INSERT INTO bookmarks_fts (bookmarks_fts, rowid, url, title, description) VALUES ('delete', old.id, old.url, old.title, old.description);
+    INSERT INTO bookmarks_fts (rowid, url, title, description) VALUES (new.id, new.url, new.title, new.description);
+END`,
+}
+
 // NewSQLiteDB returns a NewtonDB instance that is backed by an SQLiteDB stored
 // in a file.
 func NewSQLiteDB(dbPath string) (NewtonDB, error) {
@@ -162,265 +257,1913 @@ func NewSQLiteDB(dbPath string) (NewtonDB, error) {
 		return nil, errors.New("dbPath is empty")
 	}
 
-	sdb := &SQLiteNewtonDB{}
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
+	sdb := &SQLiteNewtonDB{}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	sdb.db = sqlx.NewDb(db, "sqlite3")
+
+	err = updateSQLiteDBVersion(sdb)
+	if err != nil {
+		return nil, err
+	}
+	if err = sdb.setUpBookmarkSearch(); err != nil {
+		return nil, err
+	}
+
+	return sdb, nil
+}
+
+// setUpBookmarkSearch creates the full-text index of bookmarks when SQLite
+// supports FTS5 (go-sqlite3 needs the sqlite_fts5 build tag for it). If it
+// doesn't, searches fall back to LIKE, ranked only by which fields match and
+// with snippets built by buildSnippet, and the triggers are dropped so that a
+// database last opened with FTS5 can still be written to. The index is
+// rebuilt whenever the triggers are recreated, as it may be out of date.
+func (sdb *SQLiteNewtonDB) setUpBookmarkSearch() error {
+	if _, err := sdb.db.Exec(CreateTableBookmarksFTS); err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return err
+		}
+		log.Print("SQLite was built without FTS5 (build with -tags sqlite_fts5); bookmark searches will fall back to LIKE")
+		for name := range bookmarksFTSTriggers {
+			if _, err = sdb.db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var count int
+	err := sdb.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'bookmarks_fts_%'`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != len(bookmarksFTSTriggers) {
+		tx, err := sdb.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		creator := errExecer{tx: tx}
+		for name, trigger := range bookmarksFTSTriggers {
+			creator.exec("DROP TRIGGER IF EXISTS " + name)
+			creator.exec(trigger)
+		}
+		creator.exec("INSERT INTO bookmarks_fts (bookmarks_fts) VALUES ('rebuild')")
+		if creator.err != nil {
+			return creator.err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	sdb.fullTextSearch = true
+	return nil
+}
+
+func updateSQLiteDBVersion(sdb *SQLiteNewtonDB) error {
+	// make sure the version table exists
+	_, err := sdb.db.Exec(CreateTableDatabaseVersion)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = sdb.db.QueryRow("SELECT version FROM database_version LIMIT 1").Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no problem, this is just our first run
+			_, err = sdb.db.Exec("INSERT INTO database_version (version) VALUES (0)")
+			if err != nil {
+				return err
+			}
+			version = 0
+		} else {
+			return fmt.Errorf("unable to check sqlitedb version - %v", err)
+		}
+	}
+
+	switch version {
+	case 0:
+		if err = migrateSQLiteDBFrom0To1(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 1:
+		if err = migrateSQLiteDBFrom1To2(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 2:
+		if err = migrateSQLiteDBFrom2To3(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 3:
+		if err = migrateSQLiteDBFrom3To4(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 4:
+		if err = migrateSQLiteDBFrom4To5(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 5:
+		if err = migrateSQLiteDBFrom5To6(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 6:
+		if err = migrateSQLiteDBFrom6To7(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 7:
+		if err = migrateSQLiteDBFrom7To8(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 8:
+		if err = migrateSQLiteDBFrom8To9(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 9:
+		if err = migrateSQLiteDBFrom9To10(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 10:
+		if err = migrateSQLiteDBFrom10To11(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 11:
+		if err = migrateSQLiteDBFrom11To12(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 12:
+		if err = migrateSQLiteDBFrom12To13(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 13:
+		if err = migrateSQLiteDBFrom13To14(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 14:
+		if err = migrateSQLiteDBFrom14To15(sdb); err != nil {
+			break
+		}
+		fallthrough
+	case 15:
+		err = migrateSQLiteDBFrom15To16(sdb)
+	case 16:
+	}
+
+	if err != nil {
+		return fmt.Errorf("error migrating mariadb schema - %v", err)
+	}
+
+	return nil
+}
+
+// SQLiteNewtonDB is an SQLite backed implementation of a NewtonDB
+type SQLiteNewtonDB struct {
+	db *sqlx.DB
+	// fullTextSearch is set when SQLite supports FTS5 and bookmark searches
+	// can use the bookmarks_fts index
+	fullTextSearch bool
+}
+
+func migrateSQLiteDBFrom0To1(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// create all our tables
+	creator := errExecer{tx: tx}
+	creator.exec(CreateTableBookmarks)
+	creator.exec(CreateTableUsers)
+	creator.exec(CreateTableSessions)
+	creator.exec(CreateTableContacts)
+	creator.exec(CreateTableContactsName)
+	creator.exec(CreateTableContactsEmails)
+	creator.exec(CreateTableContactsPhones)
+	creator.exec(CreateTableContactsIMAccounts)
+	creator.exec(CreateTableContactsOrganization)
+	creator.exec(CreateTableContactsRelations)
+	creator.exec(CreateTableContactsPostalAddresses)
+	creator.exec(CreateTableContactsWebsites)
+	creator.exec(CreateTableContactsEvents)
+	creator.exec(CreateTableContactsPhoto)
+
+	if creator.err != nil {
+		return creator.err
+	}
+
+	// update the version
+	_, err = tx.Exec("UPDATE database_version SET version=1")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+
+	return err
+}
+
+func migrateSQLiteDBFrom1To2(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// location_records was never part of the version 1 schema
+	_, err = tx.Exec(CreateTableLocationRecords)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE database_version SET version=2")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+
+	return err
+}
+
+func migrateSQLiteDBFrom2To3(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the primary key leads with the timestamp, which doesn't help with
+	// per-user range or bounding box queries
+	creator := errExecer{tx: tx}
+	creator.exec(CreateIndexLocationRecordsOwnerTimestamp)
+	creator.exec(CreateIndexLocationRecordsOwnerPosition)
+	creator.exec("UPDATE database_version SET version=3")
+	if creator.err != nil {
+		return creator.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom3To4(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// optional details reported by location providers
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE location_records ADD COLUMN accuracy REAL")
+	alterer.exec("ALTER TABLE location_records ADD COLUMN altitude REAL")
+	alterer.exec("ALTER TABLE location_records ADD COLUMN speed REAL")
+	alterer.exec("ALTER TABLE location_records ADD COLUMN bearing REAL")
+	alterer.exec("ALTER TABLE location_records ADD COLUMN source TEXT")
+	alterer.exec("UPDATE database_version SET version=4")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom4To5(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// track session usage so idle sessions can expire
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE sessions ADD COLUMN last_used_date TIMESTAMP")
+	alterer.exec("ALTER TABLE sessions ADD COLUMN user_agent TEXT")
+	alterer.exec("ALTER TABLE sessions ADD COLUMN device TEXT")
+	alterer.exec("UPDATE sessions SET last_used_date=creation_date")
+	alterer.exec("CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id)")
+	alterer.exec("UPDATE database_version SET version=5")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom5To6(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// access tokens are now stored as hashes, so convert the existing ones in
+	// place rather than logging everyone out
+	_, err = tx.Exec("ALTER TABLE sessions RENAME COLUMN access_token TO access_token_hash")
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[int64]string)
+	rows, err := tx.Query("SELECT id, access_token_hash FROM sessions")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var token string
+		if err = rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	updater := errExecer{tx: tx}
+	for id, token := range tokens {
+		updater.exec("UPDATE sessions SET access_token_hash=? WHERE id=?", hashToken(token), id)
+	}
+	updater.exec("CREATE UNIQUE INDEX IF NOT EXISTS sessions_access_token_hash ON sessions (access_token_hash)")
+	updater.exec("UPDATE database_version SET version=6")
+	if updater.err != nil {
+		return updater.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom6To7(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// existing sessions keep working with their non-expiring access token, but
+	// don't get a refresh token
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE sessions ADD COLUMN access_token_expiration_date TIMESTAMP")
+	alterer.exec("ALTER TABLE sessions ADD COLUMN refresh_token_hash TEXT")
+	alterer.exec("CREATE UNIQUE INDEX IF NOT EXISTS sessions_refresh_token_hash ON sessions (refresh_token_hash)")
+	alterer.exec(CreateTableRetiredRefreshTokens)
+	alterer.exec("UPDATE database_version SET version=7")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom7To8(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// admins can read and edit other users' accounts
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE users ADD COLUMN admin BOOLEAN NOT NULL DEFAULT 0")
+	alterer.exec("UPDATE database_version SET version=8")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom8To9(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	creator := errExecer{tx: tx}
+	creator.exec(CreateTableUserTOTP)
+	creator.exec(CreateTableRecoveryCodes)
+	creator.exec("UPDATE database_version SET version=9")
+	if creator.err != nil {
+		return creator.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom9To10(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE users ADD COLUMN email TEXT")
+	alterer.exec(CreateTablePasswordResets)
+	alterer.exec("CREATE INDEX IF NOT EXISTS password_resets_user_id ON password_resets (user_id)")
+	alterer.exec("UPDATE database_version SET version=10")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom10To11(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// usernames are now unique, ignoring case. If there are existing
+	// duplicates, the oldest account keeps the username and the others get
+	// their id appended to it.
+	_, err = tx.Exec("ALTER TABLE users ADD COLUMN username_normalized TEXT")
+	if err != nil {
+		return err
+	}
+
+	type user struct {
+		id       int64
+		username string
+	}
+	var users []user
+	rows, err := tx.Query("SELECT id, username FROM users ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var u user
+		if err = rows.Scan(&u.id, &u.username); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	taken := make(map[string]bool)
+	for _, u := range users {
+		taken[normalizeUsername(u.username)] = false
+	}
+	updater := errExecer{tx: tx}
+	for _, u := range users {
+		username := u.username
+		normalized := normalizeUsername(username)
+		if taken[normalized] {
+			for suffix := fmt.Sprintf("-%d", u.id); ; suffix += "-" + randAlphaNum(4) {
+				if _, exists := taken[normalizeUsername(username+suffix)]; !exists {
+					username += suffix
+					break
+				}
+			}
+			normalized = normalizeUsername(username)
+			log.Printf("user %d's username '%s' is already taken; renaming it to '%s'", u.id, u.username, username)
+		}
+		taken[normalized] = true
+		updater.exec("UPDATE users SET username=?, username_normalized=? WHERE id=?", username, normalized, u.id)
+	}
+	updater.exec("CREATE UNIQUE INDEX IF NOT EXISTS users_username_normalized ON users (username_normalized)")
+	updater.exec("UPDATE database_version SET version=11")
+	if updater.err != nil {
+		return updater.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom11To12(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// existing bookmarks end up at the top level, in the order they were
+	// created
+	alterer := errExecer{tx: tx}
+	alterer.exec(CreateTableBookmarkFolders)
+	alterer.exec("CREATE INDEX IF NOT EXISTS bookmark_folders_owner_parent ON bookmark_folders (owner_id, parent_id)")
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN folder_id INTEGER")
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN position INTEGER NOT NULL DEFAULT 0")
+	alterer.exec("UPDATE bookmarks SET position=id")
+	alterer.exec("CREATE INDEX IF NOT EXISTS bookmarks_owner_folder ON bookmarks (owner_id, folder_id)")
+	alterer.exec("UPDATE database_version SET version=12")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom12To13(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	creator := errExecer{tx: tx}
+	creator.exec(CreateTableTags)
+	creator.exec(CreateTableBookmarkTags)
+	creator.exec("CREATE INDEX IF NOT EXISTS bookmark_tags_tag_id ON bookmark_tags (tag_id)")
+	creator.exec("UPDATE database_version SET version=13")
+	if creator.err != nil {
+		return creator.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom13To14(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// we don't know when existing bookmarks were added, so theirs stays NULL
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN creation_date TIMESTAMP")
+	alterer.exec("UPDATE database_version SET version=14")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom14To15(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN description TEXT NOT NULL DEFAULT ''")
+	alterer.exec("UPDATE database_version SET version=15")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+func migrateSQLiteDBFrom15To16(sdb *SQLiteNewtonDB) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	alterer := errExecer{tx: tx}
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN favicon_url TEXT")
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN canonical_url TEXT")
+	alterer.exec("ALTER TABLE bookmarks ADD COLUMN metadata_pending INTEGER NOT NULL DEFAULT 0")
+	alterer.exec("CREATE INDEX IF NOT EXISTS bookmarks_metadata_pending ON bookmarks (metadata_pending)")
+	alterer.exec(CreateTableBookmarkSnapshots)
+	// Existing bookmarks titled "title" are left alone. Some may hold the
+	// column's old placeholder default, but there's no telling them apart
+	// from bookmarks the user named that, so clearing them would lose real
+	// titles. Users can clear the title and POST /bookmarks/{id}/metadata to
+	// fetch a new one.
+	alterer.exec("UPDATE database_version SET version=16")
+	if alterer.err != nil {
+		return alterer.err
+	}
+
+	return tx.Commit()
+}
+
+// bookmarkColumns are qualified so that they can be selected alongside the
+// columns of bookmarks_fts, which has some of the same names
+const bookmarkColumns = `bookmarks.id, bookmarks.url, bookmarks.title, bookmarks.description, bookmarks.folder_id,
+bookmarks.position, bookmarks.creation_date, bookmarks.favicon_url, bookmarks.canonical_url, bookmarks.metadata_pending,
+bookmarks.owner_id`
+
+// Bookmark ...
+func (sdb *SQLiteNewtonDB) Bookmark(bookmarkID, ownerID int64) (*Bookmark, error) {
+	const selectSQL = `SELECT ` + bookmarkColumns + ` FROM bookmarks WHERE id=? AND owner_id=?`
+	bookmark := &Bookmark{}
+	err := sdb.db.QueryRowx(selectSQL, bookmarkID, ownerID).StructScan(bookmark)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = loadBookmarkTags(sdb.db, []*Bookmark{bookmark}); err != nil {
+		return nil, err
+	}
+
+	return bookmark, nil
+}
+
+// BookmarkExists ...
+func (sdb *SQLiteNewtonDB) BookmarkExists(id int64) (bool, error) {
+	const existsSQL = `SELECT id FROM bookmarks WHERE id=?`
+	var foundID int64
+	err := sdb.db.QueryRowx(existsSQL, id).Scan(&foundID)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Bookmarks retrieves the bookmarks matching q, along with their tags
+func (sdb *SQLiteNewtonDB) Bookmarks(q *BookmarkQuery) ([]*Bookmark, error) {
+	builder := squirrel.Select(bookmarkColumns).From("bookmarks")
+	builder = builder.Where(squirrel.Eq{"bookmarks.owner_id": q.OwnerID})
+	terms := searchTerms(q.Search)
+	if len(terms) > 0 {
+		builder = sdb.searchBookmarks(builder, terms)
+	} else {
+		// without an order, pages could overlap or skip bookmarks
+		builder = builder.OrderBy("bookmarks.id")
+	}
+	if len(q.Tags) > 0 {
+		normalized := make([]string, len(q.Tags))
+		for i, tag := range q.Tags {
+			normalized[i] = normalizeTag(tag)
+		}
+		tagged := squirrel.Select("bt.bookmark_id").
+			From("bookmark_tags bt").
+			Join("tags t ON t.id=bt.tag_id").
+			Where(squirrel.Eq{"t.owner_id": q.OwnerID, "t.name_normalized": normalized})
+		if q.MatchAllTags {
+			tagged = tagged.GroupBy("bt.bookmark_id").Having("COUNT(DISTINCT t.id) = ?", countDistinct(normalized))
+		}
+		subquery, args, err := tagged.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		builder = builder.Where("bookmarks.id IN ("+subquery+")", args...)
+	}
+	if q.PageSize > 0 {
+		builder = builder.Limit(uint64(q.PageSize))
+	}
+	if q.Page > 0 {
+		builder = builder.Offset(uint64(q.Page * q.PageSize))
+	}
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	bookmarks := make([]*Bookmark, 0, 0)
+	err = sdb.db.Select(&bookmarks, query, args...)
+	if err != nil {
+		return nil, NewtonErr(err)
+	}
+	if err = loadBookmarkTags(sdb.db, bookmarks); err != nil {
+		return nil, NewtonErr(err)
+	}
+	if len(terms) > 0 {
+		for _, b := range bookmarks {
+			if b.Snippet == nil {
+				snippet := buildSnippet([]string{*b.Title, valueOrEmpty(b.Description), *b.URL}, terms)
+				b.Snippet = &snippet
+			}
+			*b.Snippet = highlightSnippet(*b.Snippet)
+		}
+	}
+
+	return bookmarks, nil
+}
+
+// searchBookmarks limits a query to the bookmarks containing every term,
+// ordered by rank. The full-text index is used if there is one, otherwise a
+// match in the title is ranked above one in the description, and that above
+// one in the url.
+func (sdb *SQLiteNewtonDB) searchBookmarks(builder squirrel.SelectBuilder, terms []string) squirrel.SelectBuilder {
+	if sdb.fullTextSearch {
+		// bm25 is negative, with the best matches the most negative
+		return builder.
+			Column("-bm25(bookmarks_fts, 1.0, 10.0, 5.0) AS rank").
+			Column(fmt.Sprintf("snippet(bookmarks_fts, -1, '%s', '%s', '%s', %d) AS snippet", snippetMatchStart, snippetMatchEnd, snippetEllipsis, snippetWords)).
+			Join("bookmarks_fts ON bookmarks_fts.rowid=bookmarks.id").
+			Where("bookmarks_fts MATCH ?", ftsQuery(terms)).
+			OrderBy("rank DESC", "bookmarks.id")
+	}
+
+	const like = ` LIKE ? ESCAPE '\'`
+	ranks := make([]string, 0, len(terms))
+	var rankArgs []interface{}
+	for _, term := range terms {
+		pattern := likePattern(term)
+		ranks = append(ranks, "3*(bookmarks.title"+like+") + 2*(bookmarks.description"+like+") + (bookmarks.url"+like+")")
+		rankArgs = append(rankArgs, pattern, pattern, pattern)
+		builder = builder.Where("(bookmarks.title"+like+" OR bookmarks.description"+like+" OR bookmarks.url"+like+")", pattern, pattern, pattern)
+	}
+	return builder.
+		Column(squirrel.Expr("CAST("+strings.Join(ranks, " + ")+" AS REAL) AS rank", rankArgs...)).
+		OrderBy("rank DESC", "bookmarks.id")
+}
+
+func valueOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func countDistinct(values []string) int {
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+// loadBookmarkTags fills in the tags of each bookmark
+func loadBookmarkTags(q sqlx.Queryer, bookmarks []*Bookmark) error {
+	if len(bookmarks) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Bookmark, len(bookmarks))
+	ids := make([]int64, 0, len(bookmarks))
+	for _, b := range bookmarks {
+		byID[*b.ID] = b
+		ids = append(ids, *b.ID)
+	}
+
+	// sqlite limits the number of parameters in a statement
+	const batchSize = 500
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		ids = ids[len(batch):]
+
+		query, args, err := squirrel.Select("bt.bookmark_id, t.name").
+			From("bookmark_tags bt").
+			Join("tags t ON t.id=bt.tag_id").
+			Where(squirrel.Eq{"bt.bookmark_id": batch}).
+			OrderBy("t.name_normalized").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := q.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var bookmarkID int64
+			var name string
+			if err = rows.Scan(&bookmarkID, &name); err != nil {
+				rows.Close()
+				return err
+			}
+			b := byID[bookmarkID]
+			b.Tags = append(b.Tags, name)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertBookmark adds a bookmark as is. Bookmarks without a title are left
+// for the metadata fetcher to fill in.
+func insertBookmark(tx *sqlx.Tx, bookmark *Bookmark) (int64, error) {
+	const insertSQL = `
+INSERT INTO bookmarks (url, title, description, folder_id, position, creation_date, metadata_pending, owner_id)
+VALUES (:url, COALESCE(:title, ''), COALESCE(:description, ''), :folder_id, COALESCE(:position, 0), :creation_date,
+        COALESCE(:title, '') = '', :owner_id)`
+	result, err := sqlx.NamedExec(tx, insertSQL, bookmark)
+	if err != nil {
+		return -1, err
+	}
+	return result.LastInsertId()
+}
+
+// setBookmarkTags replaces a bookmark's tags, creating any tags that don't
+// exist yet and deleting the ones that are no longer used
+func setBookmarkTags(tx *sqlx.Tx, ownerID, bookmarkID int64, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM bookmark_tags WHERE bookmark_id=?`, bookmarkID); err != nil {
+		return err
+	}
+	if err := addBookmarkTags(tx, ownerID, bookmarkID, tags); err != nil {
+		return err
+	}
+
+	return deleteUnusedTags(tx, ownerID)
+}
+
+// addBookmarkTags tags a bookmark, creating any tags that don't exist yet
+func addBookmarkTags(tx *sqlx.Tx, ownerID, bookmarkID int64, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO tags (name, name_normalized, owner_id) VALUES (?, ?, ?)`, tag, normalizeTag(tag), ownerID)
+		if err != nil {
+			return err
+		}
+		const linkSQL = `
+INSERT OR IGNORE INTO bookmark_tags (bookmark_id, tag_id)
+SELECT ?, id FROM tags WHERE owner_id=? AND name_normalized=?`
+		if _, err = tx.Exec(linkSQL, bookmarkID, ownerID, normalizeTag(tag)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteUnusedTags deletes the owner's tags that are no longer on any of
+// their bookmarks
+func deleteUnusedTags(tx *sqlx.Tx, ownerID int64) error {
+	const deleteSQL = `DELETE FROM tags WHERE owner_id=? AND NOT EXISTS (SELECT 1 FROM bookmark_tags bt WHERE bt.tag_id=tags.id)`
+	_, err := tx.Exec(deleteSQL, ownerID)
+	return err
+}
+
+// CreateBookmark adds a bookmark at its position in its folder, or at the end
+// if it doesn't have a position. It returns errFolderNotFound if the folder
+// doesn't belong to the bookmark's owner.
+func (sdb *SQLiteNewtonDB) CreateBookmark(bookmark *Bookmark) (int64, error) {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err = checkFolderOwner(tx, *bookmark.OwnerID, bookmark.FolderID); err != nil {
+		return -1, err
+	}
+
+	if bookmark.CreationDate == nil {
+		now := time.Now()
+		bookmark.CreationDate = &now
+	}
+	id, err := insertBookmark(tx, bookmark)
+	if err != nil {
+		return -1, err
+	}
+
+	position := -1
+	if bookmark.Position != nil {
+		position = *bookmark.Position
+	}
+	if err = placeInFolder(tx, *bookmark.OwnerID, bookmark.FolderID, folderItem{ID: id}, position); err != nil {
+		return -1, err
+	}
+	if err = setBookmarkTags(tx, *bookmark.OwnerID, id, bookmark.Tags); err != nil {
+		return -1, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// DeleteBookmark ...
+func (sdb *SQLiteNewtonDB) DeleteBookmark(bookmarkID, ownerID int64) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleter := errExecer{tx: tx}
+	deleter.exec(`DELETE FROM bookmark_tags WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE id=? AND owner_id=?)`, bookmarkID, ownerID)
+	deleter.exec(`DELETE FROM bookmark_snapshots WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE id=? AND owner_id=?)`, bookmarkID, ownerID)
+	deleter.exec(`DELETE FROM bookmarks WHERE id=? AND owner_id=?`, bookmarkID, ownerID)
+	if deleter.err != nil {
+		return deleter.err
+	}
+	if err = deleteUnusedTags(tx, ownerID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// EditBookmark updates a bookmark's url, title, description and tags
+func (sdb *SQLiteNewtonDB) EditBookmark(bookmark *Bookmark) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const editSQL = `UPDATE bookmarks SET url=:url, title=COALESCE(:title, ''), description=COALESCE(:description, '') WHERE id=:id AND owner_id=:owner_id`
+	result, err := sqlx.NamedExec(tx, editSQL, bookmark)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// not this owner's bookmark
+		return nil
+	}
+	if err = setBookmarkTags(tx, *bookmark.OwnerID, *bookmark.ID, bookmark.Tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Tags retrieves all of a user's tags, with the number of bookmarks using each
+func (sdb *SQLiteNewtonDB) Tags(ownerID int64) ([]*Tag, error) {
+	const selectSQL = `
+SELECT t.id, t.name, COUNT(bt.bookmark_id) AS count
+FROM tags t
+JOIN bookmark_tags bt ON bt.tag_id=t.id
+WHERE t.owner_id=?
+GROUP BY t.id
+ORDER BY t.name_normalized`
+	tags := make([]*Tag, 0)
+	if err := sdb.db.Select(&tags, selectSQL, ownerID); err != nil {
+		return nil, NewtonErr(err)
+	}
+
+	return tags, nil
+}
+
+// MergeTags renames a user's tags to name. If that leaves several tags with
+// the same name (or name was already taken) they're merged into one. It
+// returns errTagNotFound if any of the tags don't belong to the user.
+func (sdb *SQLiteNewtonDB) MergeTags(ownerID int64, tagIDs []int64, name string) (*Tag, error) {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return nil, NewtonErr(err)
+	}
+	defer tx.Rollback()
+
+	for _, tagID := range tagIDs {
+		var id int64
+		err = tx.QueryRow(`SELECT id FROM tags WHERE id=? AND owner_id=?`, tagID, ownerID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, errTagNotFound
+		}
+		if err != nil {
+			return nil, NewtonErr(err)
+		}
+	}
+
+	var targetID int64
+	err = tx.QueryRow(`SELECT id FROM tags WHERE owner_id=? AND name_normalized=?`, ownerID, normalizeTag(name)).Scan(&targetID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		targetID = tagIDs[0]
+	default:
+		return nil, NewtonErr(err)
+	}
+
+	merger := errExecer{tx: tx}
+	merger.exec(`UPDATE tags SET name=?, name_normalized=? WHERE id=?`, name, normalizeTag(name), targetID)
+	for _, tagID := range tagIDs {
+		if tagID == targetID {
+			continue
+		}
+		merger.exec(`INSERT OR IGNORE INTO bookmark_tags (bookmark_id, tag_id) SELECT bookmark_id, ? FROM bookmark_tags WHERE tag_id=?`, targetID, tagID)
+		merger.exec(`DELETE FROM bookmark_tags WHERE tag_id=?`, tagID)
+		merger.exec(`DELETE FROM tags WHERE id=?`, tagID)
+	}
+	if merger.err != nil {
+		return nil, NewtonErr(merger.err)
+	}
+
+	tag := &Tag{}
+	const selectSQL = `SELECT t.id, t.name, (SELECT COUNT(*) FROM bookmark_tags WHERE tag_id=t.id) AS count FROM tags t WHERE t.id=?`
+	if err = tx.QueryRowx(selectSQL, targetID).StructScan(tag); err != nil {
+		return nil, NewtonErr(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, NewtonErr(err)
+	}
+	return tag, nil
+}
+
+// BookmarksPendingMetadata retrieves bookmarks, of any user, whose metadata
+// hasn't been fetched yet, oldest first
+func (sdb *SQLiteNewtonDB) BookmarksPendingMetadata(limit int) ([]*Bookmark, error) {
+	bookmarks := make([]*Bookmark, 0)
+	const selectSQL = `SELECT ` + bookmarkColumns + ` FROM bookmarks WHERE metadata_pending=1 ORDER BY id LIMIT ?`
+	if err := sdb.db.Select(&bookmarks, selectSQL, limit); err != nil {
+		return nil, NewtonErr(err)
+	}
+
+	return bookmarks, nil
+}
+
+// RequestBookmarkMetadata marks a bookmark as needing its metadata fetched. It
+// returns errBookmarkNotFound if the bookmark doesn't belong to ownerID.
+func (sdb *SQLiteNewtonDB) RequestBookmarkMetadata(bookmarkID, ownerID int64) error {
+	result, err := sdb.db.Exec(`UPDATE bookmarks SET metadata_pending=1 WHERE id=? AND owner_id=?`, bookmarkID, ownerID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errBookmarkNotFound
+	}
+
+	return nil
+}
+
+// SetBookmarkMetadata saves what was fetched from a bookmark's page, and marks
+// it as fetched. The title and description are only filled in if the bookmark
+// doesn't have them, so that the user's own are kept. meta is nil if the page
+// couldn't be fetched, and the snapshot is only saved if meta.Text is set.
+func (sdb *SQLiteNewtonDB) SetBookmarkMetadata(bookmarkID int64, meta *PageMetadata) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	updater := errExecer{tx: tx}
+	if meta != nil {
+		const updateSQL = `
+UPDATE bookmarks SET title=CASE WHEN title='' THEN ? ELSE title END,
+                     description=CASE WHEN description='' THEN ? ELSE description END,
+                     favicon_url=NULLIF(?, ''),
+                     canonical_url=NULLIF(?, '')
+WHERE id=?`
+		updater.exec(updateSQL, meta.Title, meta.Description, meta.FaviconURL, meta.CanonicalURL, bookmarkID)
+	}
+	if meta != nil && meta.Text != "" {
+		// the bookmark may have been deleted while its page was fetched
+		const snapshotSQL = `
+INSERT OR REPLACE INTO bookmark_snapshots (bookmark_id, content, creation_date)
+SELECT id, ?, ? FROM bookmarks WHERE id=?`
+		updater.exec(snapshotSQL, meta.Text, time.Now(), bookmarkID)
+	}
+	updater.exec(`UPDATE bookmarks SET metadata_pending=0 WHERE id=?`, bookmarkID)
+	if updater.err != nil {
+		return updater.err
+	}
+
+	return tx.Commit()
+}
+
+// BookmarkSnapshot retrieves the saved text of a bookmark's page
+func (sdb *SQLiteNewtonDB) BookmarkSnapshot(bookmarkID, ownerID int64) (*BookmarkSnapshot, error) {
+	const selectSQL = `
+SELECT s.bookmark_id, s.content, s.creation_date
+FROM bookmark_snapshots s
+JOIN bookmarks b ON b.id=s.bookmark_id
+WHERE s.bookmark_id=? AND b.owner_id=?`
+	snapshot := &BookmarkSnapshot{}
+	err := sdb.db.QueryRowx(selectSQL, bookmarkID, ownerID).StructScan(snapshot)
+	switch err {
+	case nil:
+		return snapshot, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, NewtonErr(err)
+	}
+}
+
+// folderItem is a folder or bookmark in a folder
+type folderItem struct {
+	IsFolder bool  `db:"is_folder"`
+	ID       int64 `db:"id"`
+	Position int   `db:"position"`
+}
+
+// folderContents returns the folders and bookmarks directly in a folder (or
+// the top level when folderID is nil), in order
+func folderContents(tx *sqlx.Tx, ownerID int64, folderID *int64) ([]folderItem, error) {
+	const selectSQL = `
+SELECT 1 AS is_folder, id, position FROM bookmark_folders WHERE owner_id=? AND parent_id IS ?
+UNION ALL
+SELECT 0 AS is_folder, id, position FROM bookmarks WHERE owner_id=? AND folder_id IS ?
+ORDER BY position, is_folder DESC, id`
+	items := make([]folderItem, 0)
+	err := tx.Select(&items, selectSQL, ownerID, folderID, ownerID, folderID)
+	return items, err
+}
+
+// placeInFolder puts item into a folder (or the top level when folderID is
+// nil) at position, or at the end if position is negative, and renumbers
+// everything else in the folder to make room
+func placeInFolder(tx *sqlx.Tx, ownerID int64, folderID *int64, item folderItem, position int) error {
+	items, err := folderContents(tx, ownerID, folderID)
+	if err != nil {
+		return err
+	}
+
+	others := make([]folderItem, 0, len(items))
+	for _, other := range items {
+		if other.IsFolder != item.IsFolder || other.ID != item.ID {
+			others = append(others, other)
+		}
+	}
+	if position < 0 || position > len(others) {
+		position = len(others)
+	}
+	items = append(others[:position:position], item)
+	items = append(items, others[position:]...)
+
+	updater := errExecer{tx: tx}
+	for i, it := range items {
+		switch {
+		case it.ID == item.ID && it.IsFolder == item.IsFolder && item.IsFolder:
+			updater.exec(`UPDATE bookmark_folders SET parent_id=?, position=? WHERE id=?`, folderID, i, it.ID)
+		case it.ID == item.ID && it.IsFolder == item.IsFolder:
+			updater.exec(`UPDATE bookmarks SET folder_id=?, position=? WHERE id=?`, folderID, i, it.ID)
+		case it.Position == i:
+			// already in the right place
+		case it.IsFolder:
+			updater.exec(`UPDATE bookmark_folders SET position=? WHERE id=?`, i, it.ID)
+		default:
+			updater.exec(`UPDATE bookmarks SET position=? WHERE id=?`, i, it.ID)
+		}
+	}
+
+	return updater.err
+}
+
+// checkFolderOwner returns errFolderNotFound unless folderID is nil (the top
+// level) or a folder belonging to ownerID
+func checkFolderOwner(tx *sqlx.Tx, ownerID int64, folderID *int64) error {
+	if folderID == nil {
+		return nil
+	}
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM bookmark_folders WHERE id=? AND owner_id=?`, *folderID, ownerID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errFolderNotFound
+	}
+	return err
+}
+
+// MoveBookmark moves a bookmark to position in a folder (or the top level when
+// folderID is nil). A negative position means the end.
+func (sdb *SQLiteNewtonDB) MoveBookmark(bookmarkID, ownerID int64, folderID *int64, position int) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM bookmarks WHERE id=? AND owner_id=?`, bookmarkID, ownerID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errBookmarkNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err = checkFolderOwner(tx, ownerID, folderID); err != nil {
+		return err
+	}
+	if err = placeInFolder(tx, ownerID, folderID, folderItem{ID: bookmarkID}, position); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ImportBookmarks adds a tree of folders and bookmarks to the end of a folder
+// (or the top level when folderID is nil), keeping their order. The IDs of the
+// imported items are ignored. It returns errFolderNotFound if the folder
+// doesn't belong to ownerID.
+func (sdb *SQLiteNewtonDB) ImportBookmarks(ownerID int64, folderID *int64, tree *BookmarkTree) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkFolderOwner(tx, ownerID, folderID); err != nil {
+		return err
+	}
+	existing, err := folderContents(tx, ownerID, folderID)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	if len(existing) > 0 {
+		offset = existing[len(existing)-1].Position + 1
+	}
+
+	now := time.Now()
+	var importList func(parentID *int64, offset int, folders []*BookmarkFolderNode, bookmarks []*Bookmark) error
+	importList = func(parentID *int64, offset int, folders []*BookmarkFolderNode, bookmarks []*Bookmark) error {
+		for _, node := range folders {
+			const insertSQL = `INSERT INTO bookmark_folders (title, parent_id, position, owner_id) VALUES (?, ?, ?, ?)`
+			result, err := tx.Exec(insertSQL, node.Title, parentID, offset+positionOf(node.Position), ownerID)
+			if err != nil {
+				return err
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			if err = importList(&id, 0, node.Folders, node.Bookmarks); err != nil {
+				return err
+			}
+		}
+		for _, b := range bookmarks {
+			position := offset + positionOf(b.Position)
+			imported := &Bookmark{URL: b.URL, Title: b.Title, Description: b.Description, FolderID: parentID, Position: &position, CreationDate: b.CreationDate, OwnerID: &ownerID}
+			if imported.CreationDate == nil {
+				imported.CreationDate = &now
+			}
+			id, err := insertBookmark(tx, imported)
+			if err != nil {
+				return err
+			}
+			if err = addBookmarkTags(tx, ownerID, id, b.Tags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = importList(folderID, offset, tree.Folders, tree.Bookmarks); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const selectBookmarkFolderSQL = `SELECT id, title, parent_id, position, owner_id FROM bookmark_folders`
+
+// BookmarkFolder retrieves one of a user's folders
+func (sdb *SQLiteNewtonDB) BookmarkFolder(folderID, ownerID int64) (*BookmarkFolder, error) {
+	folder := &BookmarkFolder{}
+	err := sdb.db.QueryRowx(selectBookmarkFolderSQL+` WHERE id=? AND owner_id=?`, folderID, ownerID).StructScan(folder)
+	switch err {
+	case nil:
+		return folder, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, NewtonErr(err)
+	}
+}
+
+// BookmarkFolders retrieves all of a user's folders
+func (sdb *SQLiteNewtonDB) BookmarkFolders(ownerID int64) ([]*BookmarkFolder, error) {
+	folders := make([]*BookmarkFolder, 0)
+	err := sdb.db.Select(&folders, selectBookmarkFolderSQL+` WHERE owner_id=? ORDER BY parent_id, position`, ownerID)
+	if err != nil {
+		return nil, NewtonErr(err)
+	}
+
+	return folders, nil
+}
+
+// CreateBookmarkFolder adds a folder at its position in its parent, or at the
+// end if it doesn't have a position. It returns errFolderNotFound if the
+// parent doesn't belong to the folder's owner.
+func (sdb *SQLiteNewtonDB) CreateBookmarkFolder(folder *BookmarkFolder) (int64, error) {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err = checkFolderOwner(tx, *folder.OwnerID, folder.ParentID); err != nil {
+		return -1, err
+	}
+
+	const insertSQL = `INSERT INTO bookmark_folders (title, parent_id, owner_id) VALUES (:title, :parent_id, :owner_id)`
+	result, err := sqlx.NamedExec(tx, insertSQL, folder)
+	if err != nil {
+		return -1, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+
+	position := -1
+	if folder.Position != nil {
+		position = *folder.Position
+	}
+	if err = placeInFolder(tx, *folder.OwnerID, folder.ParentID, folderItem{IsFolder: true, ID: id}, position); err != nil {
+		return -1, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// EditBookmarkFolder updates a folder's title
+func (sdb *SQLiteNewtonDB) EditBookmarkFolder(folder *BookmarkFolder) error {
+	_, err := sdb.db.Exec(`UPDATE bookmark_folders SET title=? WHERE id=? AND owner_id=?`, folder.Title, folder.ID, folder.OwnerID)
+	return err
+}
+
+// MoveBookmarkFolder moves a folder to position in another folder (or the top
+// level when parentID is nil). A negative position means the end. It returns
+// errFolderCycle if the folder would end up inside itself.
+func (sdb *SQLiteNewtonDB) MoveBookmarkFolder(folderID, ownerID int64, parentID *int64, position int) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkFolderOwner(tx, ownerID, &folderID); err != nil {
+		return err
+	}
+	if err = checkFolderOwner(tx, ownerID, parentID); err != nil {
+		return err
+	}
+
+	// walk up from the new parent to make sure we don't pass through the
+	// folder being moved
+	for ancestor := parentID; ancestor != nil; {
+		if *ancestor == folderID {
+			return errFolderCycle
+		}
+		var next *int64
+		if err = tx.QueryRow(`SELECT parent_id FROM bookmark_folders WHERE id=?`, *ancestor).Scan(&next); err != nil {
+			return err
+		}
+		ancestor = next
+	}
+
+	if err = placeInFolder(tx, ownerID, parentID, folderItem{IsFolder: true, ID: folderID}, position); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteBookmarkFolder deletes a folder along with its subfolders and all of
+// the bookmarks in them
+func (sdb *SQLiteNewtonDB) DeleteBookmarkFolder(folderID, ownerID int64) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkFolderOwner(tx, ownerID, &folderID); err != nil {
+		return err
+	}
+
+	const subtree = `
+WITH RECURSIVE subtree(id) AS (
+	SELECT id FROM bookmark_folders WHERE id=?
+	UNION ALL
+	SELECT f.id FROM bookmark_folders f JOIN subtree s ON f.parent_id=s.id
+)`
+	deleter := errExecer{tx: tx}
+	deleter.exec(subtree+` DELETE FROM bookmark_tags WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE folder_id IN (SELECT id FROM subtree))`, folderID)
+	deleter.exec(subtree+` DELETE FROM bookmark_snapshots WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE folder_id IN (SELECT id FROM subtree))`, folderID)
+	deleter.exec(subtree+` DELETE FROM bookmarks WHERE folder_id IN (SELECT id FROM subtree)`, folderID)
+	deleter.exec(subtree+` DELETE FROM bookmark_folders WHERE id IN (SELECT id FROM subtree)`, folderID)
+	if deleter.err != nil {
+		return deleter.err
+	}
+	if err = deleteUnusedTags(tx, ownerID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// User ...
+func (sdb *SQLiteNewtonDB) User(id int64) (*User, error) {
+	const selectSQL = `SELECT id, username, full_name, password, admin, email FROM users WHERE id=?`
+	user := &User{}
+	err := sdb.db.QueryRowx(selectSQL, id).StructScan(user)
+	switch err {
+	case nil:
+		return user, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// UserExists ...
+func (sdb *SQLiteNewtonDB) UserExists(id int64) (bool, error) {
+	const existsSQL = `SELECT id FROM users WHERE id=?`
+	var foundID int64
+	err := sdb.db.QueryRowx(existsSQL, id).Scan(&foundID)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// UserByUsername retrieves a User object by its username
+func (sdb *SQLiteNewtonDB) UserByUsername(username string) (*User, error) {
+	const selectSQL = `SELECT id, username, full_name, password, admin, email FROM users WHERE username_normalized=?`
+	user := &User{}
+	err := sdb.db.QueryRowx(selectSQL, normalizeUsername(username)).StructScan(user)
+	switch err {
+	case nil:
+		return user, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// UsersByEmail gets the users with an email address, ignoring case. Email
+// addresses aren't unique, so there can be more than one.
+func (sdb *SQLiteNewtonDB) UsersByEmail(email string) ([]*User, error) {
+	const selectSQL = `SELECT id, username, full_name, password, admin, email FROM users WHERE email=? COLLATE NOCASE ORDER BY id`
+	users := make([]*User, 0)
+	if err := sdb.db.Select(&users, selectSQL, email); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// errUsernameTaken is returned when a username is already in use, ignoring case
+var errUsernameTaken = errors.New("username is already taken")
+
+func isUniqueConstraintErr(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// CreateUser ... It returns errUsernameTaken if the username is in use.
+func (sdb *SQLiteNewtonDB) CreateUser(user *User) (int64, error) {
+	const insertSQL = `INSERT INTO users (username, username_normalized, full_name, password, email) VALUES (?, ?, ?, ?, ?)`
+	result, err := sdb.db.Exec(insertSQL, user.Username, normalizeUsername(*user.Username), user.FullName, user.Password, user.Email)
+	if err != nil {
+		if isUniqueConstraintErr(err) {
+			return -1, errUsernameTaken
+		}
+		return -1, err
+	}
+
+	return result.LastInsertId()
+}
+
+// EditUser updates a user's username, full name and email. The password and
+// the admin flag can't be changed through here. It returns errUsernameTaken
+// if another user has the username.
+func (sdb *SQLiteNewtonDB) EditUser(user *User) error {
+	const editSQL = `UPDATE users SET username=?, username_normalized=?, full_name=?, email=? WHERE id=?`
+	_, err := sdb.db.Exec(editSQL, user.Username, normalizeUsername(*user.Username), user.FullName, user.Email, user.ID)
+	if isUniqueConstraintErr(err) {
+		return errUsernameTaken
+	}
+	return err
+}
+
+// SetUserPassword replaces a user's password hash
+func (sdb *SQLiteNewtonDB) SetUserPassword(userID int64, passwordHash string) error {
+	_, err := sdb.db.Exec(`UPDATE users SET password=? WHERE id=?`, passwordHash, userID)
+	return err
+}
+
+// DeleteUser deletes a user along with everything they own
+func (sdb *SQLiteNewtonDB) DeleteUser(userID int64) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleter := errExecer{tx: tx}
+	const ownedContacts = `(SELECT id FROM contacts WHERE owner_id=?)`
+	for _, table := range []string{
+		"contacts_name",
+		"contacts_emails",
+		"contacts_phones",
+		"contacts_im_accounts",
+		"contacts_organization",
+		"contacts_relations",
+		"contacts_postal_addresses",
+		"contacts_websites",
+		"contacts_events",
+		"contacts_photo",
+	} {
+		deleter.exec("DELETE FROM "+table+" WHERE contact_id IN "+ownedContacts, userID)
+	}
+	deleter.exec("DELETE FROM contacts WHERE owner_id=?", userID)
+	deleter.exec("DELETE FROM bookmark_tags WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE owner_id=?)", userID)
+	deleter.exec("DELETE FROM bookmark_snapshots WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE owner_id=?)", userID)
+	deleter.exec("DELETE FROM tags WHERE owner_id=?", userID)
+	deleter.exec("DELETE FROM bookmarks WHERE owner_id=?", userID)
+	deleter.exec("DELETE FROM bookmark_folders WHERE owner_id=?", userID)
+	deleter.exec("DELETE FROM location_records WHERE owner_id=?", userID)
+	deleter.exec("DELETE FROM retired_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id=?)", userID)
+	deleter.exec("DELETE FROM sessions WHERE user_id=?", userID)
+	deleter.exec("DELETE FROM recovery_codes WHERE user_id=?", userID)
+	deleter.exec("DELETE FROM user_totp WHERE user_id=?", userID)
+	deleter.exec("DELETE FROM password_resets WHERE user_id=?", userID)
+	deleter.exec("DELETE FROM users WHERE id=?", userID)
+	if deleter.err != nil {
+		return deleter.err
+	}
+
+	return tx.Commit()
+}
+
+// CreateSession writes a session object to disk and returns the id of the new record
+func (sdb *SQLiteNewtonDB) CreateSession(session *Session) (int64, error) {
+	const insertSQL = `
+INSERT INTO sessions
+	(access_token_hash, access_token_expiration_date, refresh_token_hash, user_id, creation_date, last_used_date, user_agent, device)
+VALUES
+	(:access_token_hash, :access_token_expiration_date, :refresh_token_hash, :user_id, :creation_date, :last_used_date, :user_agent, :device)`
+	result, err := sqlx.NamedExec(sdb.db, insertSQL, session)
+	if err != nil {
+		return -1, err
+	}
+
+	return result.LastInsertId()
+}
+
+const selectSessionSQL = `
+SELECT id, access_token_hash, access_token_expiration_date, refresh_token_hash, user_id, creation_date, last_used_date, user_agent, device
+FROM sessions`
+
+// SessionByAccessTokenHash gets a session from the hash of its access token
+func (sdb *SQLiteNewtonDB) SessionByAccessTokenHash(hash string) (*Session, error) {
+	session := &Session{}
+	err := sdb.db.QueryRowx(selectSessionSQL+` WHERE access_token_hash=?`, hash).StructScan(session)
+	switch err {
+	case nil:
+		return session, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// Session retrieves one of a user's sessions
+func (sdb *SQLiteNewtonDB) Session(sessionID, userID int64) (*Session, error) {
+	session := &Session{}
+	err := sdb.db.QueryRowx(selectSessionSQL+` WHERE id=? AND user_id=?`, sessionID, userID).StructScan(session)
+	switch err {
+	case nil:
+		return session, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// SessionByRefreshTokenHash gets a session from the hash of its current refresh token
+func (sdb *SQLiteNewtonDB) SessionByRefreshTokenHash(hash string) (*Session, error) {
+	session := &Session{}
+	err := sdb.db.QueryRowx(selectSessionSQL+` WHERE refresh_token_hash=?`, hash).StructScan(session)
+	switch err {
+	case nil:
+		return session, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// SessionByRetiredRefreshTokenHash finds the session that a refresh token used
+// to belong to before it was rotated. A session id of 0 means it wasn't found.
+func (sdb *SQLiteNewtonDB) SessionByRetiredRefreshTokenHash(hash string) (sessionID, userID int64, err error) {
+	const selectSQL = `
+SELECT s.id, s.user_id
+FROM retired_refresh_tokens r
+JOIN sessions s ON s.id=r.session_id
+WHERE r.token_hash=?`
+	err = sdb.db.QueryRow(selectSQL, hash).Scan(&sessionID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
 	}
-	sdb.db = sqlx.NewDb(db, "sqlite3")
+	return sessionID, userID, err
+}
 
-	err = updateSQLiteDBVersion(sdb)
+// RotateSessionTokens writes the session's new access and refresh token
+// hashes, and retires oldRefreshTokenHash so that any reuse of it can be
+// detected. It returns false if oldRefreshTokenHash was no longer the
+// session's current refresh token.
+func (sdb *SQLiteNewtonDB) RotateSessionTokens(session *Session, oldRefreshTokenHash string) (bool, error) {
+	tx, err := sdb.db.Beginx()
 	if err != nil {
-		return nil, err
+		return false, NewtonErr(err)
 	}
+	defer tx.Rollback()
 
-	return sdb, nil
-}
-
-func updateSQLiteDBVersion(sdb *SQLiteNewtonDB) error {
-	// make sure the version table exists
-	_, err := sdb.db.Exec(CreateTableDatabaseVersion)
+	const updateSQL = `
+UPDATE sessions
+SET access_token_hash=?, access_token_expiration_date=?, refresh_token_hash=?, last_used_date=?
+WHERE id=? AND refresh_token_hash=?`
+	result, err := tx.Exec(updateSQL,
+		session.AccessTokenHash,
+		session.AccessTokenExpirationDate,
+		session.RefreshTokenHash,
+		session.LastUsedDate,
+		session.ID,
+		oldRefreshTokenHash)
 	if err != nil {
-		return err
+		return false, NewtonErr(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, NewtonErr(err)
+	}
+	if affected == 0 {
+		return false, nil
 	}
 
-	var version int
-	err = sdb.db.QueryRow("SELECT version FROM database_version LIMIT 1").Scan(&version)
+	_, err = tx.Exec(`INSERT INTO retired_refresh_tokens (token_hash, session_id) VALUES (?, ?)`, oldRefreshTokenHash, session.ID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// no problem, this is just our first run
-			_, err = sdb.db.Exec("INSERT INTO database_version (version) VALUES (0)")
-			if err != nil {
-				return err
-			}
-			version = 0
-		} else {
-			return fmt.Errorf("unable to check sqlitedb version - %v", err)
-		}
+		return false, NewtonErr(err)
 	}
 
-	switch version {
-	case 0:
-		err = migrateSQLiteDBFrom0To1(sdb)
-	case 1:
+	if err = tx.Commit(); err != nil {
+		return false, NewtonErr(err)
 	}
+	return true, nil
+}
 
+// SessionsByUserID retrieves all of a user's sessions, most recently used first
+func (sdb *SQLiteNewtonDB) SessionsByUserID(userID int64) ([]*Session, error) {
+	sessions := make([]*Session, 0)
+	err := sdb.db.Select(&sessions, selectSessionSQL+` WHERE user_id=? ORDER BY last_used_date DESC`, userID)
 	if err != nil {
-		return fmt.Errorf("error migrating mariadb schema - %v", err)
+		return nil, NewtonErr(err)
 	}
 
-	return nil
+	return sessions, nil
 }
 
-// SQLiteNewtonDB is an SQLite backed implementation of a NewtonDB
-type SQLiteNewtonDB struct {
-	db *sqlx.DB
+// TouchSession records the last time a session was used
+func (sdb *SQLiteNewtonDB) TouchSession(sessionID int64, lastUsed time.Time) error {
+	_, err := sdb.db.Exec(`UPDATE sessions SET last_used_date=? WHERE id=?`, lastUsed, sessionID)
+	return err
 }
 
-func migrateSQLiteDBFrom0To1(sdb *SQLiteNewtonDB) error {
+// DeleteSession deletes a session along with its retired refresh tokens
+func (sdb *SQLiteNewtonDB) DeleteSession(sessionID, userID int64) error {
 	tx, err := sdb.db.Beginx()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// create all our tables
-	creator := errExecer{tx: tx}
-	creator.exec(CreateTableBookmarks)
-	creator.exec(CreateTableUsers)
-	creator.exec(CreateTableSessions)
-	creator.exec(CreateTableContacts)
-	creator.exec(CreateTableContactsName)
-	creator.exec(CreateTableContactsEmails)
-	creator.exec(CreateTableContactsPhones)
-	creator.exec(CreateTableContactsIMAccounts)
-	creator.exec(CreateTableContactsOrganization)
-	creator.exec(CreateTableContactsRelations)
-	creator.exec(CreateTableContactsPostalAddresses)
-	creator.exec(CreateTableContactsWebsites)
-	creator.exec(CreateTableContactsEvents)
-	creator.exec(CreateTableContactsPhoto)
-
-	if creator.err != nil {
-		return creator.err
+	deleter := errExecer{tx: tx}
+	deleter.exec(`DELETE FROM retired_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE id=? AND user_id=?)`, sessionID, userID)
+	deleter.exec(`DELETE FROM sessions WHERE id=? AND user_id=?`, sessionID, userID)
+	if deleter.err != nil {
+		return deleter.err
 	}
 
-	// update the version
-	_, err = tx.Exec("UPDATE database_version SET version=1")
+	return tx.Commit()
+}
+
+// DeleteOtherSessions deletes all of a user's sessions except keepSessionID
+func (sdb *SQLiteNewtonDB) DeleteOtherSessions(userID, keepSessionID int64) error {
+	tx, err := sdb.db.Beginx()
 	if err != nil {
 		return err
 	}
-	err = tx.Commit()
+	defer tx.Rollback()
 
-	return err
+	deleter := errExecer{tx: tx}
+	deleter.exec(`DELETE FROM retired_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id=? AND id<>?)`, userID, keepSessionID)
+	deleter.exec(`DELETE FROM sessions WHERE user_id=? AND id<>?`, userID, keepSessionID)
+	if deleter.err != nil {
+		return deleter.err
+	}
+
+	return tx.Commit()
 }
 
-// Bookmark ...
-func (sdb *SQLiteNewtonDB) Bookmark(bookmarkID, ownerID int64) (*Bookmark, error) {
-	const selectSQL = `SELECT id, url, title, owner_id FROM bookmarks WHERE id=? AND owner_id=?`
-	bookmark := &Bookmark{}
-	err := sdb.db.QueryRowx(selectSQL, bookmarkID, ownerID).StructScan(bookmark)
+// CreatePasswordReset stores a password reset token
+func (sdb *SQLiteNewtonDB) CreatePasswordReset(reset *PasswordReset) error {
+	const insertSQL = `
+INSERT INTO password_resets (user_id, token_hash, creation_date, expiration_date)
+VALUES (:user_id, :token_hash, :creation_date, :expiration_date)`
+	result, err := sqlx.NamedExec(sdb.db, insertSQL, reset)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+		return NewtonErr(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return NewtonErr(err)
 	}
+	reset.ID = &id
 
-	return bookmark, nil
+	return nil
 }
 
-// BookmarkExists ...
-func (sdb *SQLiteNewtonDB) BookmarkExists(id int64) (bool, error) {
-	const existsSQL = `SELECT id FROM bookmarks WHERE id=?`
-	var foundID int64
-	err := sdb.db.QueryRowx(existsSQL, id).Scan(&foundID)
+// PasswordResetUserID returns the id of the user that an unused and unexpired
+// password reset token belongs to, or 0 if there isn't one
+func (sdb *SQLiteNewtonDB) PasswordResetUserID(tokenHash string, now time.Time) (int64, error) {
+	const selectSQL = `SELECT user_id FROM password_resets WHERE token_hash=? AND used=0 AND expiration_date>?`
+	var userID int64
+	err := sdb.db.QueryRow(selectSQL, tokenHash, now).Scan(&userID)
 	switch err {
 	case nil:
-		return true, nil
+		return userID, nil
 	case sql.ErrNoRows:
-		return false, nil
+		return 0, nil
 	default:
-		return false, err
+		return 0, NewtonErr(err)
 	}
 }
 
-// Bookmarks ...
-func (sdb *SQLiteNewtonDB) Bookmarks(ownerID int64, pageSize int, page int) ([]*Bookmark, error) {
-	builder := squirrel.Select("id, url, title, owner_id").From("bookmarks")
-	builder = builder.Where(squirrel.Eq{"owner_id": ownerID})
-	if pageSize > 0 {
-		builder = builder.Limit(uint64(pageSize))
-	}
-	if page > 0 {
-		builder = builder.Offset(uint64(page * pageSize))
-	}
-	query, args, err := builder.ToSql()
+// ResetPassword uses a password reset token to replace the user's password
+// hash. All of the user's outstanding reset tokens are used up and all of
+// their sessions are deleted. It returns false if the token wasn't valid.
+func (sdb *SQLiteNewtonDB) ResetPassword(tokenHash, passwordHash string, now time.Time) (bool, error) {
+	tx, err := sdb.db.Beginx()
 	if err != nil {
-		return nil, err
+		return false, NewtonErr(err)
 	}
+	defer tx.Rollback()
 
-	bookmarks := make([]*Bookmark, 0, 0)
-	err = sdb.db.Select(&bookmarks, query, args...)
-	if err != nil {
-		return nil, NewtonErr(err)
+	var userID int64
+	const selectSQL = `SELECT user_id FROM password_resets WHERE token_hash=? AND used=0 AND expiration_date>?`
+	err = tx.QueryRow(selectSQL, tokenHash, now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
 	}
-
-	return bookmarks, nil
-}
-
-// CreateBookmark ...
-func (sdb *SQLiteNewtonDB) CreateBookmark(bookmark *Bookmark) (int64, error) {
-	const insertSQL = `INSERT INTO bookmarks (url, title, owner_id) VALUES (:url, :title, :owner_id)`
-	result, err := sqlx.NamedExec(sdb.db, insertSQL, bookmark)
 	if err != nil {
-		return -1, err
+		return false, NewtonErr(err)
 	}
 
-	return result.LastInsertId()
-}
-
-// DeleteBookmark ...
-func (sdb *SQLiteNewtonDB) DeleteBookmark(bookmarkID, ownerID int64) error {
-	const deleteSQL = `DELETE FROM bookmarks WHERE id=? AND owner_id=?`
-	_, err := sdb.db.Exec(deleteSQL, bookmarkID, ownerID)
-	return err
-}
+	updater := errExecer{tx: tx}
+	updater.exec(`UPDATE password_resets SET used=1 WHERE user_id=?`, userID)
+	updater.exec(`UPDATE users SET password=? WHERE id=?`, passwordHash, userID)
+	updater.exec(`DELETE FROM retired_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id=?)`, userID)
+	updater.exec(`DELETE FROM sessions WHERE user_id=?`, userID)
+	if updater.err != nil {
+		return false, NewtonErr(updater.err)
+	}
 
-// EditBookmark ...
-func (sdb *SQLiteNewtonDB) EditBookmark(bookmark *Bookmark) error {
-	const editSQL = `UPDATE bookmarks SET url=:url, title=:title WHERE id=:id`
-	_, err := sdb.db.NamedExec(editSQL, bookmark)
-	return err
+	if err = tx.Commit(); err != nil {
+		return false, NewtonErr(err)
+	}
+	return true, nil
 }
 
-// User ...
-func (sdb *SQLiteNewtonDB) User(id int64) (*User, error) {
-	const selectSQL = `SELECT id, username, full_name, password FROM users WHERE id=?`
-	user := &User{}
-	err := sdb.db.QueryRowx(selectSQL, id).StructScan(user)
+// UserTOTP retrieves a user's two-factor authentication secret
+func (sdb *SQLiteNewtonDB) UserTOTP(userID int64) (*UserTOTP, error) {
+	const selectSQL = `SELECT user_id, secret, confirmed, last_counter, creation_date FROM user_totp WHERE user_id=?`
+	totp := &UserTOTP{}
+	err := sdb.db.QueryRowx(selectSQL, userID).StructScan(totp)
 	switch err {
 	case nil:
-		return user, nil
+		return totp, nil
 	case sql.ErrNoRows:
 		return nil, nil
 	default:
-		return nil, err
+		return nil, NewtonErr(err)
 	}
 }
 
-// UserExists ...
-func (sdb *SQLiteNewtonDB) UserExists(id int64) (bool, error) {
-	const existsSQL = `SELECT id FROM users WHERE id=?`
-	var foundID int64
-	err := sdb.db.QueryRowx(existsSQL, id).Scan(&foundID)
-	switch err {
-	case nil:
-		return true, nil
-	case sql.ErrNoRows:
-		return false, nil
-	default:
-		return false, err
-	}
+// SetUserTOTP replaces a user's two-factor authentication secret with an
+// unconfirmed one
+func (sdb *SQLiteNewtonDB) SetUserTOTP(totp *UserTOTP) error {
+	const insertSQL = `
+INSERT OR REPLACE INTO user_totp (user_id, secret, confirmed, last_counter, creation_date)
+VALUES (:user_id, :secret, 0, 0, :creation_date)`
+	_, err := sqlx.NamedExec(sdb.db, insertSQL, totp)
+	return err
 }
 
-// UserByUsername retrieves a User object by its username
-func (sdb *SQLiteNewtonDB) UserByUsername(username string) (*User, error) {
-	const selectSQL = `SELECT id, username, full_name, password FROM users WHERE username=?`
-	user := &User{}
-	err := sdb.db.QueryRowx(selectSQL, username).StructScan(user)
-	switch err {
-	case nil:
-		return user, nil
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
-		return nil, err
+// ConfirmUserTOTP enables a user's two-factor authentication and replaces
+// their recovery codes. counter is the time step of the code used to confirm.
+func (sdb *SQLiteNewtonDB) ConfirmUserTOTP(userID, counter int64, recoveryCodeHashes []string) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	updater := errExecer{tx: tx}
+	updater.exec(`UPDATE user_totp SET confirmed=1, last_counter=? WHERE user_id=?`, counter, userID)
+	setRecoveryCodes(&updater, userID, recoveryCodeHashes)
+	if updater.err != nil {
+		return updater.err
 	}
+
+	return tx.Commit()
 }
 
-// CreateUser ...
-func (sdb *SQLiteNewtonDB) CreateUser(user *User) (int64, error) {
-	const insertSQL = `INSERT INTO users (username, full_name, password) VALUES (:username, :full_name, :password)`
-	result, err := sqlx.NamedExec(sdb.db, insertSQL, user)
+// SetRecoveryCodes replaces a user's recovery codes
+func (sdb *SQLiteNewtonDB) SetRecoveryCodes(userID int64, recoveryCodeHashes []string) error {
+	tx, err := sdb.db.Beginx()
 	if err != nil {
-		return -1, err
+		return err
+	}
+	defer tx.Rollback()
+
+	updater := errExecer{tx: tx}
+	setRecoveryCodes(&updater, userID, recoveryCodeHashes)
+	if updater.err != nil {
+		return updater.err
 	}
 
-	return result.LastInsertId()
+	return tx.Commit()
 }
 
-// EditUser ...
-func (sdb *SQLiteNewtonDB) EditUser(user *User) error {
-	const editSQL = `UPDATE users SET username=?, full_name=?, password=?`
-	_, err := sdb.db.Exec(editSQL, user.Username, user.FullName, user.Password)
-	return err
+func setRecoveryCodes(ee *errExecer, userID int64, recoveryCodeHashes []string) {
+	ee.exec(`DELETE FROM recovery_codes WHERE user_id=?`, userID)
+	for _, hash := range recoveryCodeHashes {
+		ee.exec(`INSERT INTO recovery_codes (code_hash, user_id) VALUES (?, ?)`, hash, userID)
+	}
 }
 
-// CreateSession writes a session object to disk and returns the id of the new record
-func (sdb *SQLiteNewtonDB) CreateSession(session *Session) (int64, error) {
-	const insertSQL = `INSERT INTO sessions (access_token, user_id, creation_date) VALUES (:access_token, :user_id, :creation_date)`
-	result, err := sqlx.NamedExec(sdb.db, insertSQL, session)
+// UseTOTPCounter records that the code for a time step has been used, so that
+// it (or any earlier one) can't be replayed. It returns false if it already
+// has been.
+func (sdb *SQLiteNewtonDB) UseTOTPCounter(userID, counter int64) (bool, error) {
+	const updateSQL = `UPDATE user_totp SET last_counter=? WHERE user_id=? AND confirmed=1 AND last_counter<?`
+	result, err := sdb.db.Exec(updateSQL, counter, userID, counter)
 	if err != nil {
-		return -1, err
+		return false, NewtonErr(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, NewtonErr(err)
 	}
 
-	return result.LastInsertId()
+	return affected == 1, nil
 }
 
-// SessionByAccessToken gets a session from it's access token
-func (sdb *SQLiteNewtonDB) SessionByAccessToken(token string) (*Session, error) {
-	const selectSQL = `SELECT id, access_token, user_id, creation_date FROM sessions WHERE access_token=?`
-	session := &Session{}
-	err := sdb.db.QueryRowx(selectSQL, token).StructScan(session)
-	switch err {
-	case nil:
-		return session, nil
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
-		return nil, err
+// UseRecoveryCode deletes one of a user's recovery codes. It returns false if
+// the user didn't have it.
+func (sdb *SQLiteNewtonDB) UseRecoveryCode(userID int64, recoveryCodeHash string) (bool, error) {
+	result, err := sdb.db.Exec(`DELETE FROM recovery_codes WHERE user_id=? AND code_hash=?`, userID, recoveryCodeHash)
+	if err != nil {
+		return false, NewtonErr(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, NewtonErr(err)
+	}
+
+	return affected == 1, nil
+}
+
+// DeleteUserTOTP disables a user's two-factor authentication
+func (sdb *SQLiteNewtonDB) DeleteUserTOTP(userID int64) error {
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleter := errExecer{tx: tx}
+	deleter.exec(`DELETE FROM recovery_codes WHERE user_id=?`, userID)
+	deleter.exec(`DELETE FROM user_totp WHERE user_id=?`, userID)
+	if deleter.err != nil {
+		return deleter.err
 	}
+
+	return tx.Commit()
 }
 
 // CreateContact persists a contact
@@ -777,29 +2520,107 @@ func (sdb *SQLiteNewtonDB) ContactOwner(contactID int64) (int64, error) {
 
 // AddLocationRecord ...
 func (sdb *SQLiteNewtonDB) AddLocationRecord(locRec *LocationRecord) error {
-	const insertSQL = `INSERT INTO location_records (timestamp, latitude, longitude, owner_id) VALUES (:timestamp, :latitude, :longitude, :owner_id)`
+	const insertSQL = `
+INSERT INTO location_records
+	(timestamp, latitude, longitude, accuracy, altitude, speed, bearing, source, owner_id)
+VALUES
+	(:timestamp, :latitude, :longitude, :accuracy, :altitude, :speed, :bearing, :source, :owner_id)`
 	_, err := sqlx.NamedExec(sdb.db, insertSQL, locRec)
 	return err
 }
 
-// LocationRecords ...
-func (sdb *SQLiteNewtonDB) LocationRecords(ownerID, since, until int64, limit uint64, ascending bool) ([]LocationRecord, error) {
-	builder := squirrel.Select("timestamp, latitude, longitude, ownerID").From("location_records")
-	builder = builder.Where(squirrel.Eq{"owner_id": ownerID})
-	if ascending {
+// AddLocationRecords inserts all the records in a single transaction. It
+// returns the number of new records, and the number that collided with an
+// existing (timestamp, owner_id) pair, which are skipped or replaced according
+// to policy.
+func (sdb *SQLiteNewtonDB) AddLocationRecords(records []*LocationRecord, policy LocationConflictPolicy) (int, int, error) {
+	if policy != LocationConflictSkip && policy != LocationConflictReplace {
+		return 0, 0, fmt.Errorf("unknown location conflict policy %d", policy)
+	}
+
+	tx, err := sdb.db.Beginx()
+	if err != nil {
+		return 0, 0, NewtonErr(err)
+	}
+	defer tx.Rollback()
+
+	existsStmt, err := tx.Prepare(`SELECT COUNT(*) FROM location_records WHERE timestamp=? AND owner_id=?`)
+	if err != nil {
+		return 0, 0, NewtonErr(err)
+	}
+	defer existsStmt.Close()
+	insertStmt, err := tx.Prepare(`INSERT OR REPLACE INTO location_records (timestamp, latitude, longitude, accuracy, altitude, speed, bearing, source, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, 0, NewtonErr(err)
+	}
+	defer insertStmt.Close()
+
+	inserted, duplicates := 0, 0
+	for _, rec := range records {
+		var existing int
+		if err = existsStmt.QueryRow(rec.Timestamp, rec.OwnerID).Scan(&existing); err != nil {
+			return 0, 0, NewtonErr(err)
+		}
+		if existing > 0 {
+			duplicates++
+			if policy == LocationConflictSkip {
+				continue
+			}
+		} else {
+			inserted++
+		}
+		_, err = insertStmt.Exec(rec.Timestamp, rec.Latitude, rec.Longitude, rec.Accuracy, rec.Altitude, rec.Speed, rec.Bearing, rec.Source, rec.OwnerID)
+		if err != nil {
+			return 0, 0, NewtonErr(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, NewtonErr(err)
+	}
+
+	return inserted, duplicates, nil
+}
+
+func locationRecordsQuery(q *LocationQuery) squirrel.SelectBuilder {
+	builder := squirrel.Select("timestamp, latitude, longitude, accuracy, altitude, speed, bearing, source, owner_id").From("location_records")
+	builder = builder.Where(squirrel.Eq{"owner_id": q.OwnerID})
+	if q.Ascending {
 		builder = builder.OrderBy("timestamp ASC")
 	} else {
 		builder = builder.OrderBy("timestamp DESC")
 	}
-	if limit > 0 {
-		builder = builder.Limit(limit)
+	if q.Limit > 0 {
+		builder = builder.Limit(q.Limit)
+	}
+	if q.Since != -1 {
+		builder = builder.Where(squirrel.Expr("timestamp > ?", q.Since))
+	}
+	if q.Until != -1 {
+		builder = builder.Where(squirrel.Expr("timestamp < ?", q.Until))
 	}
-	if since != -1 {
-		builder = builder.Where(squirrel.Expr("timestamp > ?", since))
+	if q.MaxAccuracy > 0 {
+		builder = builder.Where(squirrel.Expr("(accuracy IS NULL OR accuracy <= ?)", q.MaxAccuracy))
 	}
-	if until != -1 {
-		builder = builder.Where(squirrel.Expr("timestamp < ?", until))
+	if bounds := q.Bounds; bounds != nil {
+		builder = builder.Where(squirrel.Expr("latitude BETWEEN ? AND ?", bounds.MinLatitude, bounds.MaxLatitude))
+		if bounds.MinLongitude <= bounds.MaxLongitude {
+			builder = builder.Where(squirrel.Expr("longitude BETWEEN ? AND ?", bounds.MinLongitude, bounds.MaxLongitude))
+		} else {
+			// the box crosses the antimeridian
+			builder = builder.Where(squirrel.Or{
+				squirrel.Expr("longitude >= ?", bounds.MinLongitude),
+				squirrel.Expr("longitude <= ?", bounds.MaxLongitude),
+			})
+		}
 	}
+
+	return builder
+}
+
+// LocationRecords retrieves the location records selected by q
+func (sdb *SQLiteNewtonDB) LocationRecords(q *LocationQuery) ([]LocationRecord, error) {
+	builder := locationRecordsQuery(q)
 	query, args, err := builder.ToSql()
 	if err != nil {
 		return nil, err
@@ -812,3 +2633,33 @@ func (sdb *SQLiteNewtonDB) LocationRecords(ownerID, since, until int64, limit ui
 
 	return records, nil
 }
+
+// EachLocationRecord calls fn with each of the location records selected by q,
+// without loading them all into memory. Iteration stops at the first error
+// returned by fn. The record passed to fn is reused between calls, so it must
+// be copied if fn needs to hold on to it.
+func (sdb *SQLiteNewtonDB) EachLocationRecord(q *LocationQuery, fn func(*LocationRecord) error) error {
+	builder := locationRecordsQuery(q)
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := sdb.db.Queryx(query, args...)
+	if err != nil {
+		return NewtonErr(err)
+	}
+	defer rows.Close()
+
+	record := &LocationRecord{}
+	for rows.Next() {
+		if err = rows.StructScan(record); err != nil {
+			return NewtonErr(err)
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Tag is a label that can be attached to any number of a user's bookmarks
+type Tag struct {
+	ID    *int64  `json:"id,omitempty"db:"id"`
+	Name  *string `json:"name,omitempty"db:"name"`
+	Count *int    `json:"count,omitempty"db:"count"`
+}
+
+const maxTagLength = 64
+
+// errTagNotFound is returned when a tag doesn't exist or belongs to someone
+// else
+var errTagNotFound = errors.New("tag not found")
+
+// normalizeTag returns the form of a tag name that's used to compare it with
+// others, so that tags differing only in case are the same tag
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func validateTag(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("tags can't be empty")
+	}
+	if utf8.RuneCountInString(name) > maxTagLength {
+		return fmt.Errorf("tags can't be longer than %d characters", maxTagLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || c == ',' {
+			return fmt.Errorf("the tag '%s' can't contain commas or control characters", name)
+		}
+	}
+
+	return nil
+}
+
+// cleanTags validates tags, trims them and removes duplicates
+func cleanTags(tags []string) ([]string, error) {
+	cleaned := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if err := validateTag(tag); err != nil {
+			return nil, err
+		}
+		normalized := normalizeTag(tag)
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		cleaned = append(cleaned, strings.TrimSpace(tag))
+	}
+
+	return cleaned, nil
+}
+
+// BookmarkQuery describes which of a user's bookmarks to retrieve
+type BookmarkQuery struct {
+	OwnerID int64
+	// Tags limits the results to bookmarks with any of these tags, or all of
+	// them if MatchAllTags is set
+	Tags         []string
+	MatchAllTags bool
+	// Search limits the results to bookmarks containing every word of it,
+	// ordered by how well they match
+	Search string
+	// PageSize of 0 returns every bookmark
+	PageSize int
+	Page     int
+}
+
+// NewBookmarkQuery returns a query for all of a user's bookmarks
+func NewBookmarkQuery(ownerID int64) *BookmarkQuery {
+	return &BookmarkQuery{OwnerID: ownerID}
+}
+
+// parseBookmarkQuery reads the 'page', 'page_size', 'q', 'tag' and 'tag_mode'
+// query parameters used when retrieving bookmarks. 'tag' can be repeated, and
+// 'tag_mode' is either 'all' (the default) or 'any'.
+func parseBookmarkQuery(args url.Values, ownerID int64) (*BookmarkQuery, error) {
+	q := NewBookmarkQuery(ownerID)
+	var err error
+	if q.Page, q.PageSize, err = pageAndSize(args, 10); err != nil {
+		return nil, err
+	}
+
+	q.Search = strings.TrimSpace(args.Get("q"))
+	for _, tag := range args["tag"] {
+		if strings.TrimSpace(tag) != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	switch args.Get("tag_mode") {
+	case "", "all":
+		q.MatchAllTags = true
+	case "any":
+		q.MatchAllTags = false
+	default:
+		return nil, errors.New("'tag_mode' must be 'all' or 'any'")
+	}
+
+	return q, nil
+}
+
+func parseTagID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["tag_id"], 10, 64)
+	if err != nil {
+		sendBadReq(w, "invalid tag id")
+		return 0, false
+	}
+
+	return id, true
+}
+
+// GetTagsHandler handles GET /tags
+//
+// It returns all of the user's tags with the number of bookmarks using each.
+func GetTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := db().Tags(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, tags)
+}
+
+// RenameTagHandler handles PUT /tags/{tag_id}
+//
+// If another tag already has the new 'name', the two are merged.
+func RenameTagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	tagID, ok := parseTagID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Name *string `json:"name,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	if body.Name == nil {
+		sendBadReq(w, "You need to provide a 'name'")
+		return
+	}
+	if err := validateTag(*body.Name); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	tag, err := db().MergeTags(userID, []int64{tagID}, strings.TrimSpace(*body.Name))
+	if err == errTagNotFound {
+		sendNotFound(w, fmt.Sprintf("tag %d not found", tagID))
+		return
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, tag)
+}
+
+// MergeTagsHandler handles POST /tags/merge
+//
+// It replaces the tags in 'tag_ids' with the tag 'into', creating it if
+// necessary.
+func MergeTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		TagIDs []int64 `json:"tag_ids,omitempty"`
+		Into   *string `json:"into,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode the request json")
+		return
+	}
+	if len(body.TagIDs) == 0 {
+		sendBadReq(w, "You need to provide the 'tag_ids' to merge")
+		return
+	}
+	if body.Into == nil {
+		sendBadReq(w, "You need to provide the tag to merge 'into'")
+		return
+	}
+	if err := validateTag(*body.Into); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	tag, err := db().MergeTags(userID, body.TagIDs, strings.TrimSpace(*body.Into))
+	if err == errTagNotFound {
+		sendNotFound(w, "tag not found")
+		return
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, tag)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginThrottle tracks failed login attempts by key (e.g. a username or an IP
+// address). Once a key has more than freeAttempts failures, each further
+// attempt has to wait exponentially longer, starting at baseDelay, and once it
+// reaches lockoutAttempts failures it's locked out for lockoutDuration. Keys
+// are forgotten after they've gone forgetAfter without a failure.
+type loginThrottle struct {
+	freeAttempts    int
+	lockoutAttempts int
+	baseDelay       time.Duration
+	lockoutDuration time.Duration
+	forgetAfter     time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	retryAfter  time.Time
+	lockedUntil time.Time
+}
+
+// maxThrottleEntries is how many keys a throttle tracks before it prunes the
+// ones that have been forgotten
+const maxThrottleEntries = 10000
+
+func newLoginThrottle(freeAttempts, lockoutAttempts int, baseDelay, lockoutDuration time.Duration) *loginThrottle {
+	return &loginThrottle{
+		freeAttempts:    freeAttempts,
+		lockoutAttempts: lockoutAttempts,
+		baseDelay:       baseDelay,
+		lockoutDuration: lockoutDuration,
+		forgetAfter:     lockoutDuration + time.Hour,
+		failures:        make(map[string]*loginFailures),
+	}
+}
+
+// gUsernameThrottle limits password guessing against a single account
+var gUsernameThrottle = newLoginThrottle(5, 10, time.Second, 15*time.Minute)
+
+// gIPThrottle limits password guessing from a single address across many
+// accounts. It's more lenient since many users can share an address.
+var gIPThrottle = newLoginThrottle(20, 100, time.Second, 15*time.Minute)
+
+// wait returns how long key has to wait before its next attempt is allowed
+func (lt *loginThrottle) wait(key string, now time.Time) time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	return lt.waitLocked(key, now)
+}
+
+// waitLocked must be called with lt.mu held
+func (lt *loginThrottle) waitLocked(key string, now time.Time) time.Duration {
+	f := lt.failures[key]
+	if f == nil {
+		return 0
+	}
+	if now.Sub(f.last) > lt.forgetAfter {
+		delete(lt.failures, key)
+		return 0
+	}
+
+	until := f.retryAfter
+	if f.lockedUntil.After(until) {
+		until = f.lockedUntil
+	}
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed attempt for key
+func (lt *loginThrottle) fail(key string, now time.Time) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lt.failLocked(key, now)
+}
+
+// reserve allows an attempt for key if it doesn't have to wait, counting it
+// as a failure straight away so that attempts made in parallel can't all get
+// through. It returns how long to wait if the attempt isn't allowed. An
+// attempt that turns out not to have failed is taken back with release.
+func (lt *loginThrottle) reserve(key string, now time.Time) time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if wait := lt.waitLocked(key, now); wait > 0 {
+		return wait
+	}
+	lt.failLocked(key, now)
+	return 0
+}
+
+// release takes back a reserved attempt. A lockout the attempt started isn't
+// lifted.
+func (lt *loginThrottle) release(key string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	f := lt.failures[key]
+	if f == nil {
+		return
+	}
+	if f.count > 0 {
+		f.count--
+	}
+	if f.count <= lt.freeAttempts {
+		f.retryAfter = time.Time{}
+	}
+}
+
+// failLocked must be called with lt.mu held
+func (lt *loginThrottle) failLocked(key string, now time.Time) {
+	if len(lt.failures) >= maxThrottleEntries {
+		lt.prune(now)
+	}
+
+	f := lt.failures[key]
+	if f == nil || now.Sub(f.last) > lt.forgetAfter {
+		f = &loginFailures{}
+		lt.failures[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= lt.lockoutAttempts {
+		f.lockedUntil = now.Add(lt.lockoutDuration)
+		// start over once the lockout ends, but with no free attempts
+		f.count = lt.freeAttempts
+		return
+	}
+	if f.count > lt.freeAttempts {
+		delay := lt.baseDelay << uint(f.count-lt.freeAttempts-1)
+		if delay > lt.lockoutDuration || delay <= 0 {
+			delay = lt.lockoutDuration
+		}
+		f.retryAfter = now.Add(delay)
+	}
+}
+
+// reset forgets all the failures recorded for key
+func (lt *loginThrottle) reset(key string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	delete(lt.failures, key)
+}
+
+// prune must be called with lt.mu held
+func (lt *loginThrottle) prune(now time.Time) {
+	for key, f := range lt.failures {
+		if now.Sub(f.last) > lt.forgetAfter && !f.lockedUntil.After(now) {
+			delete(lt.failures, key)
+		}
+	}
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttleKeys returns the keys a login attempt is tracked under
+func throttleKeys(username string, r *http.Request) (usernameKey, ipKey string) {
+	return strings.ToLower(strings.TrimSpace(username)), clientIP(r)
+}
+
+// loginAttempt is a password or second factor check that has been counted as
+// a failure in advance, under both the username and the client's address
+type loginAttempt struct {
+	usernameKey string
+	ipKey       string
+	done        bool
+}
+
+// beginLoginAttempt reserves an attempt to log in as username, or returns how
+// long the client has to wait before another attempt is allowed. The caller
+// should defer release, and call failed or succeeded once it knows the
+// outcome.
+func beginLoginAttempt(username string, r *http.Request, now time.Time) (*loginAttempt, time.Duration) {
+	usernameKey, ipKey := throttleKeys(username, r)
+	if wait := gUsernameThrottle.reserve(usernameKey, now); wait > 0 {
+		return nil, wait
+	}
+	if wait := gIPThrottle.reserve(ipKey, now); wait > 0 {
+		gUsernameThrottle.release(usernameKey)
+		return nil, wait
+	}
+	return &loginAttempt{usernameKey: usernameKey, ipKey: ipKey}, 0
+}
+
+// failed keeps the attempt counted as a failure
+func (a *loginAttempt) failed() {
+	a.done = true
+}
+
+// succeeded forgets the username's failures, and takes back the attempt
+// counted against the client's address
+func (a *loginAttempt) succeeded() {
+	if a.done {
+		return
+	}
+	a.done = true
+	gUsernameThrottle.reset(a.usernameKey)
+	gIPThrottle.release(a.ipKey)
+}
+
+// release takes back an attempt whose outcome wasn't a failure, e.g. because
+// of an internal error or because a second factor is still needed. It does
+// nothing after failed or succeeded.
+func (a *loginAttempt) release() {
+	if a.done {
+		return
+	}
+	a.done = true
+	gUsernameThrottle.release(a.usernameKey)
+	gIPThrottle.release(a.ipKey)
+}
+
+func recordLoginSuccess(username string, r *http.Request) {
+	usernameKey, _ := throttleKeys(username, r)
+	gUsernameThrottle.reset(usernameKey)
+}
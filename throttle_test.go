@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	lt := newLoginThrottle(2, 5, time.Second, time.Minute)
+	now := time.Now()
+
+	lt.fail("hank", now)
+	lt.fail("hank", now)
+	if wait := lt.wait("hank", now); wait != 0 {
+		t.Fatalf("free attempts shouldn't be delayed, found %v", wait)
+	}
+
+	lt.fail("hank", now)
+	if wait := lt.wait("hank", now); wait != time.Second {
+		t.Fatalf("expected a 1s delay, found %v", wait)
+	}
+	lt.fail("hank", now)
+	if wait := lt.wait("hank", now); wait != 2*time.Second {
+		t.Fatalf("expected the delay to double, found %v", wait)
+	}
+	if wait := lt.wait("peggy", now); wait != 0 {
+		t.Fatalf("other keys shouldn't be affected, found %v", wait)
+	}
+
+	lt.fail("hank", now)
+	if wait := lt.wait("hank", now); wait != time.Minute {
+		t.Fatalf("expected to be locked out, found %v", wait)
+	}
+	if wait := lt.wait("hank", now.Add(2*time.Minute)); wait != 0 {
+		t.Fatalf("the lockout should have ended, found %v", wait)
+	}
+
+	lt.reset("hank")
+	if wait := lt.wait("hank", now); wait != 0 {
+		t.Fatalf("reset should clear the failures, found %v", wait)
+	}
+}
+
+func TestLoginThrottleReserve(t *testing.T) {
+	lt := newLoginThrottle(2, 5, time.Second, time.Minute)
+	now := time.Now()
+
+	// attempts made at the same time can't all get past the free ones
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if lt.reserve("hank", now) == 0 {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected 3 attempts to be allowed before the first delay, found %d", allowed)
+	}
+
+	// attempts that didn't fail are taken back
+	lt = newLoginThrottle(2, 5, time.Second, time.Minute)
+	for i := 0; i < 3; i++ {
+		if wait := lt.reserve("hank", now); wait != 0 {
+			t.Fatalf("attempt %d shouldn't have been delayed, found %v", i, wait)
+		}
+		lt.release("hank")
+	}
+	if wait := lt.wait("hank", now); wait != 0 {
+		t.Fatalf("released attempts shouldn't cause a delay, found %v", wait)
+	}
+}
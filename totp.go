@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserTOTP is a user's time-based one-time password (RFC 6238) enrollment.
+// It isn't enforced until it's been confirmed with a valid code.
+type UserTOTP struct {
+	UserID       int64     `db:"user_id"`
+	Secret       string    `db:"secret"`
+	Confirmed    bool      `db:"confirmed"`
+	LastCounter  int64     `db:"last_counter"`
+	CreationDate time.Time `db:"creation_date"`
+}
+
+const (
+	totpIssuer = "Newton"
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many periods before and after the current one are
+	// accepted, to allow for clock drift
+	totpSkew = 1
+
+	numRecoveryCodes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret generates a random 160 bit secret, base32 encoded
+func newTOTPSecret() string {
+	secret := make([]byte, 20)
+	if _, err := crand.Read(secret); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(secret)
+}
+
+// totpURI returns the otpauth:// URI that authenticator apps use to enroll
+func totpURI(secret, username string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the HOTP value (RFC 4226) of key for counter
+func totpCode(key []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// totpCounter returns the time step that t falls in
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// checkTOTPCode returns the time step that code is valid for, or false if it
+// isn't valid at time now
+func checkTOTPCode(secret, code string, now time.Time) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter, totpDigits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes generates a set of single use recovery codes, returning the
+// codes to show the user and the hashes to store
+func newRecoveryCodes() (codes []string, hashes []string) {
+	for i := 0; i < numRecoveryCodes; i++ {
+		code := strings.ToLower(randAlphaNum(10))
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(code, "-", "", -1)
+}
+
+// totpChallenge is handed out after a user with two-factor authentication
+// enabled provides the correct password. The session is only created once the
+// challenge is completed with a code.
+type totpChallenge struct {
+	userID     int64
+	username   string
+	userAgent  *string
+	device     *string
+	expiration time.Time
+	attempts   int
+}
+
+const (
+	totpChallengeLifetime    = 5 * time.Minute
+	maxTOTPChallengeAttempts = 5
+)
+
+// totpChallenges holds the outstanding challenges, keyed by the hash of the
+// challenge token
+type totpChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]*totpChallenge
+}
+
+var gTOTPChallenges = &totpChallenges{challenges: make(map[string]*totpChallenge)}
+
+// add stores c and returns the token that the client has to send back
+func (tc *totpChallenges) add(c *totpChallenge, now time.Time) string {
+	token := randAlphaNum(32)
+	c.expiration = now.Add(totpChallengeLifetime)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for hash, other := range tc.challenges {
+		if now.After(other.expiration) {
+			delete(tc.challenges, hash)
+		}
+	}
+	tc.challenges[hashToken(token)] = c
+
+	return token
+}
+
+// attempt returns the challenge for token and counts an attempt against it.
+// Challenges are discarded once they expire or run out of attempts.
+func (tc *totpChallenges) attempt(token string, now time.Time) *totpChallenge {
+	hash := hashToken(token)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	c := tc.challenges[hash]
+	if c == nil {
+		return nil
+	}
+	if now.After(c.expiration) {
+		delete(tc.challenges, hash)
+		return nil
+	}
+	c.attempts++
+	if c.attempts >= maxTOTPChallengeAttempts {
+		delete(tc.challenges, hash)
+	}
+	return c
+}
+
+// complete discards the challenge for token
+func (tc *totpChallenges) complete(token string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.challenges, hashToken(token))
+}
+
+// EnrollTOTPHandler handles POST /users/{user_id}/totp
+//
+// It generates a new secret for the user's authenticator app. Two-factor
+// authentication isn't enabled until the secret is confirmed.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseOwnUserID(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := db().UserTOTP(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if existing != nil && existing.Confirmed {
+		sendBadReq(w, "two-factor authentication is already enabled")
+		return
+	}
+
+	user, err := db().User(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	totp := &UserTOTP{UserID: userID, Secret: newTOTPSecret(), CreationDate: time.Now()}
+	if err = db().SetUserTOTP(totp); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{Secret: totp.Secret, URI: totpURI(totp.Secret, *user.Username)})
+}
+
+// ConfirmTOTPHandler handles POST /users/{user_id}/totp/confirm
+//
+// A valid code from the authenticator app enables two-factor authentication
+// and returns the user's recovery codes. This is the only time they're shown.
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseOwnUserID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Code *string `json:"code,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.Code == nil {
+		sendBadReq(w, "you need to specify a 'code'")
+		return
+	}
+
+	totp, err := db().UserTOTP(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if totp == nil {
+		sendBadReq(w, "two-factor authentication hasn't been set up")
+		return
+	}
+	if totp.Confirmed {
+		sendBadReq(w, "two-factor authentication is already enabled")
+		return
+	}
+
+	counter, valid := checkTOTPCode(totp.Secret, *body.Code, time.Now())
+	if !valid {
+		sendBadReq(w, "invalid 'code'")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	if err = db().ConfirmUserTOTP(userID, counter, hashes); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodesHandler handles POST /users/{user_id}/totp/recovery_codes
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseOwnUserID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Code *string `json:"code,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.Code == nil {
+		sendBadReq(w, "you need to specify a 'code'")
+		return
+	}
+
+	totp, err := db().UserTOTP(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if totp == nil || !totp.Confirmed {
+		sendBadReq(w, "two-factor authentication isn't enabled")
+		return
+	}
+	if ok, err = useTOTPCode(totp, *body.Code, time.Now()); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !ok {
+		sendBadReq(w, "invalid 'code'")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	if err = db().SetRecoveryCodes(userID, hashes); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+}
+
+// DisableTOTPHandler handles DELETE /users/{user_id}/totp
+//
+// It needs the user's 'password', and once two-factor authentication is
+// confirmed, a 'code' from the authenticator app or one of the user's
+// 'recovery_code's as well, so that a password alone can't turn it off.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseOwnUserID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Password     *string `json:"password,omitempty"`
+		Code         *string `json:"code,omitempty"`
+		RecoveryCode *string `json:"recovery_code,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.Password == nil {
+		sendBadReq(w, "you need to specify your 'password'")
+		return
+	}
+
+	user, err := db().User(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	totp, err := db().UserTOTP(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if totp == nil {
+		sendBadReq(w, "two-factor authentication isn't enabled")
+		return
+	}
+	if totp.Confirmed && body.Code == nil && body.RecoveryCode == nil {
+		sendBadReq(w, "you need to specify a 'code' or a 'recovery_code'")
+		return
+	}
+
+	now := time.Now()
+	attempt, wait := beginLoginAttempt(*user.Username, r, now)
+	if wait > 0 {
+		sendTooManyRequests(w, "too many failed password attempts; try again later", wait)
+		return
+	}
+	defer attempt.release()
+	match, _, err := verifyPassword(*user.Password, *body.Password)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !match {
+		attempt.failed()
+		sendUnauthorized(w, "incorrect 'password'")
+		return
+	}
+
+	// an enrollment that was never confirmed can be dropped with just the
+	// password, as it isn't protecting anything yet
+	if totp.Confirmed {
+		var valid bool
+		if body.Code != nil {
+			valid, err = useTOTPCode(totp, *body.Code, now)
+		} else {
+			valid, err = db().UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(*body.RecoveryCode)))
+		}
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		if !valid {
+			attempt.failed()
+			sendUnauthorized(w, "incorrect 'code'")
+			return
+		}
+	}
+	attempt.succeeded()
+
+	if err = db().DeleteUserTOTP(userID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
+
+// useTOTPCode checks code against the user's secret, and makes sure that it
+// can't be used again
+func useTOTPCode(totp *UserTOTP, code string, now time.Time) (bool, error) {
+	counter, valid := checkTOTPCode(totp.Secret, code, now)
+	if !valid {
+		return false, nil
+	}
+	return db().UseTOTPCounter(totp.UserID, counter)
+}
+
+// CompleteTOTPChallengeHandler handles POST /sessions/totp
+//
+// It exchanges the challenge token returned by POST /sessions, along with
+// either a 'code' from the authenticator app or one of the user's
+// 'recovery_code's, for a session.
+func CompleteTOTPChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ChallengeToken *string `json:"challenge_token,omitempty"`
+		Code           *string `json:"code,omitempty"`
+		RecoveryCode   *string `json:"recovery_code,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.ChallengeToken == nil || *body.ChallengeToken == "" {
+		sendBadReq(w, "you need to specify a 'challenge_token'")
+		return
+	}
+	if body.Code == nil && body.RecoveryCode == nil {
+		sendBadReq(w, "you need to specify a 'code' or a 'recovery_code'")
+		return
+	}
+
+	now := time.Now()
+	challenge := gTOTPChallenges.attempt(*body.ChallengeToken, now)
+	if challenge == nil {
+		sendUnauthorized(w, "invalid or expired 'challenge_token'; log in again")
+		return
+	}
+	attempt, wait := beginLoginAttempt(challenge.username, r, now)
+	if wait > 0 {
+		sendTooManyRequests(w, "too many failed login attempts; try again later", wait)
+		return
+	}
+	defer attempt.release()
+
+	totp, err := db().UserTOTP(challenge.userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	if totp == nil || !totp.Confirmed {
+		// two-factor authentication was disabled after the challenge was issued
+		gTOTPChallenges.complete(*body.ChallengeToken)
+		sendUnauthorized(w, "invalid or expired 'challenge_token'; log in again")
+		return
+	}
+
+	var valid bool
+	if body.Code != nil {
+		valid, err = useTOTPCode(totp, *body.Code, now)
+	} else {
+		valid, err = db().UseRecoveryCode(challenge.userID, hashToken(normalizeRecoveryCode(*body.RecoveryCode)))
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !valid {
+		attempt.failed()
+		sendUnauthorized(w, "incorrect 'code'")
+		return
+	}
+	gTOTPChallenges.complete(*body.ChallengeToken)
+	attempt.succeeded()
+
+	session := NewSession(challenge.userID)
+	session.UserAgent = challenge.userAgent
+	session.Device = challenge.device
+	sessionID, err := db().CreateSession(session)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	session.ID = &sessionID
+
+	sendSuccess(w, session)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238, appendix B
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+	for _, v := range vectors {
+		if code := totpCode(key, totpCounter(time.Unix(v.unix, 0)), 8); code != v.code {
+			t.Errorf("at %d expected %s, found %s", v.unix, v.code, code)
+		}
+	}
+}
+
+func TestCheckTOTPCode(t *testing.T) {
+	secret := newTOTPSecret()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code := totpCode(key, totpCounter(now), totpDigits)
+
+	counter, ok := checkTOTPCode(secret, code, now)
+	if !ok || counter != totpCounter(now) {
+		t.Fatal("the current code wasn't accepted")
+	}
+	if _, ok = checkTOTPCode(secret, code, now.Add(totpPeriod*time.Second)); !ok {
+		t.Fatal("the previous code should be accepted to allow for clock drift")
+	}
+	if _, ok = checkTOTPCode(secret, code, now.Add(5*totpPeriod*time.Second)); ok {
+		t.Fatal("an old code was accepted")
+	}
+	if _, ok = checkTOTPCode(secret, "12345", now); ok {
+		t.Fatal("a short code was accepted")
+	}
+
+	uri := totpURI(secret, "hank")
+	if !strings.HasPrefix(uri, "otpauth://totp/Newton:hank?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("unexpected uri %s", uri)
+	}
+}
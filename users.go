@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // User represents a user
@@ -16,6 +19,13 @@ type User struct {
 	Username *string `json:"username,omitempty"db:"username"`
 	FullName *string `json:"full_name,omitempty"db:"full_name"`
 	Password *string `json:"password,omitempty"db:"password"`
+	Admin    *bool   `json:"admin,omitempty"db:"admin"`
+	Email    *string `json:"email,omitempty"db:"email"`
+}
+
+// IsAdmin reports whether the user has the admin role
+func (u *User) IsAdmin() bool {
+	return u.Admin != nil && *u.Admin
 }
 
 // NewUser populates a User object
@@ -28,7 +38,11 @@ func NewUser(username, fullName, password string) *User {
 	return user
 }
 
-func parseUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+// parseUserID returns the id of the user in the request's path after making
+// sure the authenticated user (requesterID) is allowed to access it. Only the
+// user themself or an admin may do so; everyone else gets the same not found
+// response as for a user that doesn't exist.
+func parseUserID(w http.ResponseWriter, r *http.Request, requesterID int64) (int64, bool) {
 	vars := mux.Vars(r)
 	idStr := vars["user_id"]
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -36,6 +50,19 @@ func parseUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
 		sendBadReq(w, "invalid user id")
 		return 0, false
 	}
+
+	if id != requesterID {
+		requester, err := db().User(requesterID)
+		if err != nil {
+			sendInternalErr(w, err)
+			return 0, false
+		}
+		if requester == nil || !requester.IsAdmin() {
+			sendNotFound(w, fmt.Sprintf("user %d not found", id))
+			return 0, false
+		}
+	}
+
 	exists, err := db().UserExists(id)
 	if err != nil {
 		sendInternalErr(w, err)
@@ -49,6 +76,79 @@ func parseUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
 	return id, true
 }
 
+// authenticateOwnUser is like parseUserID, but only lets users act on their
+// own account, even if they're an admin. It returns the requester's session.
+func authenticateOwnUser(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	session, ok := authenticateSession(w, r)
+	if !ok {
+		return nil, false
+	}
+	userID, ok := parseUserID(w, r, *session.UserID)
+	if !ok {
+		return nil, false
+	}
+	if userID != *session.UserID {
+		sendNotFound(w, fmt.Sprintf("user %d not found", userID))
+		return nil, false
+	}
+
+	return session, true
+}
+
+// parseOwnUserID returns the id of the authenticated user, after making sure
+// it's the one in the request's path
+func parseOwnUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	session, ok := authenticateOwnUser(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	return *session.UserID, true
+}
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+// normalizeUsername returns the form of a username that's used to compare it
+// with others, so that usernames differing only in case are the same
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// validateUsername checks a new username. Usernames are made of ASCII
+// letters, digits, '.', '_' and '-', and start with a letter or digit.
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("the 'username' needs to be between %d and %d characters long", minUsernameLength, maxUsernameLength)
+	}
+	for i, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return errors.New("the 'username' can only contain letters, digits, '.', '_' and '-', and has to start with a letter or digit")
+		}
+	}
+
+	return nil
+}
+
+// normalizeEmail validates an email address and strips any display name. An
+// empty address is returned as nil, so that it can be cleared.
+func normalizeEmail(email *string) (*string, error) {
+	if email == nil || strings.TrimSpace(*email) == "" {
+		return nil, nil
+	}
+	addr, err := mail.ParseAddress(*email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'email' - %v", err)
+	}
+
+	return &addr.Address, nil
+}
+
 // CreateUserHandler handles POST /users
 func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
@@ -59,11 +159,16 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user.ID = nil
+	user.Admin = nil
 
 	if user.Username == nil {
 		sendBadReq(w, "You need to provide a 'username'")
 		return
 	}
+	if err = validateUsername(*user.Username); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
 	if user.FullName == nil {
 		sendBadReq(w, "You need to provide a 'full_name'")
 		return
@@ -72,17 +177,27 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		sendBadReq(w, "You need to provide a 'password'")
 		return
 	}
+	if err = validatePassword(*user.Password, *user.Username); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+	if user.Email, err = normalizeEmail(user.Email); err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
 
-	// run the password through bcrypt
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(*user.Password), bcrypt.MaxCost)
+	hash, err := hashPassword(*user.Password)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
-	hashString := string(hashBytes)
-	user.Password = &hashString
+	user.Password = &hash
 
 	id, err := db().CreateUser(user)
+	if err == errUsernameTaken {
+		sendConflict(w, fmt.Sprintf("the username '%s' is already taken", *user.Username))
+		return
+	}
 	if err != nil {
 		sendInternalErr(w, err)
 		return
@@ -97,7 +212,12 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 
 // GetUserHandler handles GET /users/{user_id}
 func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	userID, ok := parseUserID(w, r)
+	requesterID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ok := parseUserID(w, r, requesterID)
 	if !ok {
 		return
 	}
@@ -116,7 +236,12 @@ func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 
 // EditUserHandler handles PUT /users/{user_id}
 func EditUserHandler(w http.ResponseWriter, r *http.Request) {
-	userID, ok := parseUserID(w, r)
+	requesterID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ok := parseUserID(w, r, requesterID)
 	if !ok {
 		return
 	}
@@ -127,28 +252,41 @@ func EditUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	oldPassword := user.Password
-
-	dec := json.NewDecoder(r.Body)
-	if err = dec.Decode(user); err != nil {
+	edits := &User{}
+	if err = json.NewDecoder(r.Body).Decode(edits); err != nil {
 		sendBadReq(w, "unable to decode request json")
 		return
 	}
-
-	// check if they're updating the password
-	if *user.Password != *oldPassword {
-		// we need to hash the new password, before writing it out to the db
-		hashBytes, err := bcrypt.GenerateFromPassword([]byte(*user.Password), bcrypt.MaxCost)
-		if err != nil {
-			sendInternalErr(w, err)
+	if edits.Password != nil {
+		sendBadReq(w, fmt.Sprintf("the password can only be changed with PUT /users/%d/password", userID))
+		return
+	}
+	// only the profile fields can be edited, so the admin role can't be
+	// granted through the API
+	if edits.Username != nil && *edits.Username != *user.Username {
+		if err = validateUsername(*edits.Username); err != nil {
+			sendBadReq(w, err.Error())
+			return
+		}
+		user.Username = edits.Username
+	}
+	if edits.FullName != nil {
+		user.FullName = edits.FullName
+	}
+	if edits.Email != nil {
+		if user.Email, err = normalizeEmail(edits.Email); err != nil {
+			sendBadReq(w, err.Error())
 			return
 		}
-		hashString := string(hashBytes)
-		user.Password = &hashString
 	}
 
 	user.ID = &userID
-	if err = db().EditUser(user); err != nil {
+	err = db().EditUser(user)
+	if err == errUsernameTaken {
+		sendConflict(w, fmt.Sprintf("the username '%s' is already taken", *user.Username))
+		return
+	}
+	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
@@ -158,3 +296,138 @@ func EditUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	sendSuccess(w, user)
 }
+
+// ChangePasswordHandler handles PUT /users/{user_id}/password
+//
+// The current password is required. All of the user's other sessions are
+// revoked, so anyone who knew the old password is logged out.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := authenticateOwnUser(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		CurrentPassword *string `json:"current_password,omitempty"`
+		NewPassword     *string `json:"new_password,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.CurrentPassword == nil {
+		sendBadReq(w, "you need to specify the 'current_password'")
+		return
+	}
+	if body.NewPassword == nil {
+		sendBadReq(w, "you need to specify a 'new_password'")
+		return
+	}
+
+	user, err := db().User(*session.UserID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	now := time.Now()
+	attempt, wait := beginLoginAttempt(*user.Username, r, now)
+	if wait > 0 {
+		sendTooManyRequests(w, "too many failed password attempts; try again later", wait)
+		return
+	}
+	defer attempt.release()
+	match, _, err := verifyPassword(*user.Password, *body.CurrentPassword)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !match {
+		attempt.failed()
+		sendUnauthorized(w, "incorrect 'current_password'")
+		return
+	}
+
+	if err = validatePassword(*body.NewPassword, *user.Username); err != nil {
+		sendBadReq(w, strings.Replace(err.Error(), "'password'", "'new_password'", 1))
+		return
+	}
+	if *body.NewPassword == *body.CurrentPassword {
+		sendBadReq(w, "the 'new_password' has to be different from the current one")
+		return
+	}
+
+	hash, err := hashPassword(*body.NewPassword)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err = db().SetUserPassword(*user.ID, hash); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err = db().DeleteOtherSessions(*user.ID, *session.ID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
+
+// DeleteUserHandler handles DELETE /users/{user_id}
+//
+// The account and all of its data are deleted for good. The requester has to
+// confirm with their 'password'.
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	requesterID, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ok := parseUserID(w, r, requesterID)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Password *string `json:"password,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode request json")
+		return
+	}
+	if body.Password == nil {
+		sendBadReq(w, "you need to confirm with your 'password'")
+		return
+	}
+
+	requester, err := db().User(requesterID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	now := time.Now()
+	attempt, wait := beginLoginAttempt(*requester.Username, r, now)
+	if wait > 0 {
+		sendTooManyRequests(w, "too many failed password attempts; try again later", wait)
+		return
+	}
+	defer attempt.release()
+	match, _, err := verifyPassword(*requester.Password, *body.Password)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !match {
+		attempt.failed()
+		sendUnauthorized(w, "incorrect 'password'")
+		return
+	}
+
+	if err = db().DeleteUser(userID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -58,6 +59,18 @@ func randAlphaNum(length int) string {
 	return s
 }
 
+// truncateString shortens s to at most maxBytes bytes without splitting a
+// UTF-8 sequence
+func truncateString(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
 type newtonErr struct {
 	err  error
 	file string
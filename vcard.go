@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// vCardWriter writes contacts out as vCard 4.0 (RFC 6350)
+type vCardWriter struct {
+	w *bufio.Writer
+}
+
+func newVCardWriter(w io.Writer) *vCardWriter {
+	return &vCardWriter{w: bufio.NewWriter(w)}
+}
+
+// vCardEscape escapes a text value
+func vCardEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, ",", `\,`, -1)
+	s = strings.Replace(s, ";", `\;`, -1)
+	s = strings.Replace(s, "\r\n", `\n`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// vCardComponents escapes each value and joins them as a structured value,
+// e.g. for N or ADR
+func vCardComponents(values ...*string) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		if v != nil {
+			escaped[i] = vCardEscape(*v)
+		}
+	}
+	return strings.Join(escaped, ";")
+}
+
+// line writes a content line, folding it so that no line is longer than 75
+// octets
+func (vw *vCardWriter) line(name, params, value string) {
+	line := name
+	if params != "" {
+		line += ";" + params
+	}
+	line += ":" + value
+
+	const maxLen = 75
+	for first := true; len(line) > 0; first = false {
+		limit := maxLen
+		if !first {
+			// continuation lines start with a space
+			vw.w.WriteString(" ")
+			limit--
+		}
+		n := len(line)
+		if n > limit {
+			n = limit
+			for n > 0 && !utf8.RuneStart(line[n]) {
+				n--
+			}
+		}
+		vw.w.WriteString(line[:n])
+		vw.w.WriteString("\r\n")
+		line = line[n:]
+	}
+}
+
+func typeParam(types string) string {
+	if types == "" {
+		return ""
+	}
+	return "TYPE=" + types
+}
+
+var vCardEmailTypes = map[EmailType]string{
+	EmailTypeHome: "home",
+	EmailTypeWork: "work",
+}
+
+var vCardPhoneTypes = map[PhoneType]string{
+	PhoneTypeHome:        "home,voice",
+	PhoneTypeMobile:      "cell",
+	PhoneTypeWork:        "work,voice",
+	PhoneTypeFaxWork:     "work,fax",
+	PhoneTypeFaxHome:     "home,fax",
+	PhoneTypePager:       "pager",
+	PhoneTypeCar:         "voice",
+	PhoneTypeCompanyMain: "work",
+	PhoneTypeMain:        "voice",
+	PhoneTypeOtherFax:    "fax",
+	PhoneTypeTTYTDD:      "textphone",
+	PhoneTypeWorkMobile:  "work,cell",
+	PhoneTypeWorkPager:   "work,pager",
+}
+
+var vCardIMSchemes = map[IMProtocol]string{
+	IMProtocolAIM:      "aim",
+	IMProtocolMSN:      "msnim",
+	IMProtocolYahoo:    "ymsgr",
+	IMProtocolSkype:    "skype",
+	IMProtocolQQ:       "mqq",
+	IMProtocolHangouts: "gtalk",
+	IMProtocolICQ:      "icq",
+	IMProtocolXMPP:     "xmpp",
+}
+
+var vCardIMTypes = map[IMType]string{
+	IMTypeHome: "home",
+	IMTypeWork: "work",
+}
+
+var vCardRelationTypes = map[RelationType]string{
+	RelationTypeAssistant:       "agent",
+	RelationTypeBrother:         "sibling",
+	RelationTypeChild:           "child",
+	RelationTypeDomesticPartner: "sweetheart",
+	RelationTypeFather:          "parent",
+	RelationTypeFriend:          "friend",
+	RelationTypeManager:         "co-worker",
+	RelationTypeMother:          "parent",
+	RelationTypeParent:          "parent",
+	RelationTypePartner:         "sweetheart",
+	RelationTypeReferredBy:      "contact",
+	RelationTypeRelative:        "kin",
+	RelationTypeSister:          "sibling",
+	RelationTypeSpouse:          "spouse",
+}
+
+var vCardAddressTypes = map[PostalAddressType]string{
+	PostalAddressTypeHome: "home",
+	PostalAddressTypeWork: "work",
+}
+
+var (
+	fullDateRE   = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})$`)
+	monthDayRE   = regexp.MustCompile(`^--(\d{2})-?(\d{2})$`)
+	schemeCharRE = regexp.MustCompile(`[^a-z0-9+.-]`)
+)
+
+// vCardDate converts an event's start date to a vCard date. Dates that aren't
+// in a recognized format are written as text.
+func vCardDate(date string) (params, value string) {
+	if m := fullDateRE.FindStringSubmatch(date); m != nil {
+		return "", m[1] + m[2] + m[3]
+	}
+	if m := monthDayRE.FindStringSubmatch(date); m != nil {
+		return "", "--" + m[1] + m[2]
+	}
+	return "VALUE=text", vCardEscape(date)
+}
+
+// contactFormattedName returns the name to show for a contact, which every
+// vCard must have
+func contactFormattedName(c *Contact) string {
+	if c.Name != nil {
+		if c.Name.DisplayName != nil && *c.Name.DisplayName != "" {
+			return *c.Name.DisplayName
+		}
+		var parts []string
+		for _, part := range []*string{c.Name.Prefix, c.Name.GivenName, c.Name.MiddleName, c.Name.FamilyName, c.Name.Suffix} {
+			if part != nil && *part != "" {
+				parts = append(parts, *part)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, " ")
+		}
+	}
+	if c.Nickname != nil && *c.Nickname != "" {
+		return *c.Nickname
+	}
+	if c.Org != nil && c.Org.Company != nil && *c.Org.Company != "" {
+		return *c.Org.Company
+	}
+	return ""
+}
+
+// writeContact writes a contact, along with its photo if it has one.
+// Anything without a vCard equivalent (e.g. custom labels and phonetic names)
+// is left out.
+func (vw *vCardWriter) writeContact(c *Contact, photo []byte) error {
+	vw.line("BEGIN", "", "VCARD")
+	vw.line("VERSION", "", "4.0")
+	if c.ID != nil {
+		vw.line("UID", "", fmt.Sprintf("urn:newton:contact:%d", *c.ID))
+	}
+	vw.line("FN", "", vCardEscape(contactFormattedName(c)))
+	if c.Name != nil {
+		n := c.Name
+		vw.line("N", "", vCardComponents(n.FamilyName, n.GivenName, n.MiddleName, n.Prefix, n.Suffix))
+	}
+	if c.Nickname != nil && *c.Nickname != "" {
+		vw.line("NICKNAME", "", vCardEscape(*c.Nickname))
+	}
+	for _, e := range c.Emails {
+		vw.line("EMAIL", typeParam(vCardEmailTypes[e.Type]), vCardEscape(e.Address))
+	}
+	for _, p := range c.Phones {
+		vw.line("TEL", typeParam(vCardPhoneTypes[p.Type]), vCardEscape(p.Number))
+	}
+	for _, im := range c.IMAccounts {
+		scheme := vCardIMSchemes[im.Protocol]
+		if scheme == "" && im.CustomProtocol != nil {
+			scheme = "x-" + schemeCharRE.ReplaceAllString(strings.ToLower(*im.CustomProtocol), "")
+		}
+		if scheme == "" || scheme == "x-" {
+			continue
+		}
+		vw.line("IMPP", typeParam(vCardIMTypes[im.Type]), scheme+":"+im.Handle)
+	}
+	if c.Org != nil {
+		if c.Org.Company != nil && *c.Org.Company != "" {
+			vw.line("ORG", "", vCardEscape(*c.Org.Company))
+		}
+		if c.Org.Title != nil && *c.Org.Title != "" {
+			vw.line("TITLE", "", vCardEscape(*c.Org.Title))
+		}
+	}
+	for _, rel := range c.Relations {
+		params := "VALUE=text"
+		if t := vCardRelationTypes[rel.Type]; t != "" {
+			params += ";TYPE=" + t
+		}
+		vw.line("RELATED", params, vCardEscape(rel.Name))
+	}
+	for _, a := range c.PostalAddresses {
+		// the second component is the extended address, which we don't have
+		value := vCardComponents(a.POBox, nil, a.Street, a.City, a.Region, a.PostCode, a.Country)
+		vw.line("ADR", typeParam(vCardAddressTypes[a.Type]), value)
+	}
+	for _, site := range c.Websites {
+		vw.line("URL", "", site)
+	}
+	for _, e := range c.Events {
+		var name string
+		switch e.Type {
+		case EventTypeBirthday:
+			name = "BDAY"
+		case EventTypeAnniversary:
+			name = "ANNIVERSARY"
+		default:
+			continue
+		}
+		params, value := vCardDate(e.StartDate)
+		vw.line(name, params, value)
+	}
+	if c.Note != nil && *c.Note != "" {
+		vw.line("NOTE", "", vCardEscape(*c.Note))
+	}
+	if len(photo) > 0 {
+		mimeType := http.DetectContentType(photo)
+		vw.line("PHOTO", "", "data:"+mimeType+";base64,"+base64.StdEncoding.EncodeToString(photo))
+	}
+	vw.line("END", "", "VCARD")
+
+	return vw.w.Flush()
+}